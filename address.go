@@ -0,0 +1,188 @@
+package platform
+
+import (
+	"fmt"
+	"net"
+	"path"
+)
+
+// Blocks that are not routed on the internet, in order of preference: the
+// RFC1918 blocks, RFC6598 shared address space and IPv6 unique local
+// addresses.
+var privateAddressBlocks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+// Interfaces skipped unless AddressOptions.ExcludeInterfaces says otherwise.
+// They are container and VM bridges, whose addresses other hosts cannot
+// reach.
+var DefaultExcludeInterfaces = []string{"docker*", "br-*", "veth*", "virbr*", "cni*", "flannel*", "cali*", "kube-*"}
+
+// AddressOptions controls which of the host's addresses a service
+// advertises.
+type AddressOptions struct {
+	// Interfaces restricts the search to interfaces whose name matches one
+	// of these shell patterns, such as "eth*". Empty means every interface.
+	Interfaces []string
+	// ExcludeInterfaces skips interfaces whose name matches one of these
+	// patterns. Nil means DefaultExcludeInterfaces.
+	ExcludeInterfaces []string
+	// Prefer lists CIDRs in order of preference. An address in an earlier
+	// block wins over one in a later block or in none, and listing a public
+	// block allows its addresses to be picked at all.
+	Prefer []string
+	// PreferIPv6 ranks IPv6 addresses ahead of IPv4 ones.
+	PreferIPv6 bool
+}
+
+// InterfaceAddr is an address assigned to a named interface.
+type InterfaceAddr struct {
+	Interface string
+	IP        net.IP
+}
+
+// InterfaceAddrs lists the addresses of every interface that is up.
+func InterfaceAddrs() ([]InterfaceAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get interfaces: %v", err)
+	}
+
+	addrs := make([]InterfaceAddr, 0)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		raw, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range raw {
+			var ip net.IP
+			switch addr := a.(type) {
+			case *net.IPAddr:
+				ip = addr.IP
+			case *net.IPNet:
+				ip = addr.IP
+			default:
+				continue
+			}
+			addrs = append(addrs, InterfaceAddr{Interface: iface.Name, IP: ip})
+		}
+	}
+	return addrs, nil
+}
+
+// AdvertiseAddr picks the address of this host that a service should
+// advertise, see SelectAddress.
+func AdvertiseAddr(opts AddressOptions) (net.IP, error) {
+	addrs, err := InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	return SelectAddress(addrs, opts)
+}
+
+// SelectAddress picks the best address out of addrs. Loopback, link-local
+// and addresses on excluded interfaces are never picked, and only private
+// addresses or ones in a preferred block are considered. Candidates are
+// ranked by the preferred blocks, then by family, then by the private block
+// they belong to, and finally by their order in addrs.
+func SelectAddress(addrs []InterfaceAddr, opts AddressOptions) (net.IP, error) {
+	prefer, err := parseCIDRs(opts.Prefer...)
+	if err != nil {
+		return nil, err
+	}
+
+	exclude := opts.ExcludeInterfaces
+	if exclude == nil {
+		exclude = DefaultExcludeInterfaces
+	}
+
+	var best *candidate
+	for _, a := range addrs {
+		ip := a.IP
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+			continue
+		}
+		if len(opts.Interfaces) > 0 && !matchAny(opts.Interfaces, a.Interface) {
+			continue
+		}
+		if matchAny(exclude, a.Interface) {
+			continue
+		}
+
+		c := &candidate{ip: ip, preferred: blockIndex(prefer, ip), rank: blockIndex(privateAddressBlocks, ip)}
+		if c.preferred == len(prefer) && c.rank == len(privateAddressBlocks) {
+			continue
+		}
+		if (ip.To4() == nil) != opts.PreferIPv6 {
+			c.family = 1
+		}
+
+		if best == nil || c.better(best) {
+			best = c
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("No private IP address found")
+	}
+	return best.ip, nil
+}
+
+// candidate is an address ranked by SelectAddress. Lower values win.
+type candidate struct {
+	ip        net.IP
+	preferred int
+	family    int
+	rank      int
+}
+
+func (c *candidate) better(other *candidate) bool {
+	if c.preferred != other.preferred {
+		return c.preferred < other.preferred
+	}
+	if c.family != other.family {
+		return c.family < other.family
+	}
+	return c.rank < other.rank
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// blockIndex returns the index of the first block containing ip, or
+// len(blocks) when none does.
+func blockIndex(blocks []*net.IPNet, ip net.IP) int {
+	for i, b := range blocks {
+		if b.Contains(ip) {
+			return i
+		}
+	}
+	return len(blocks)
+}
+
+func parseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	blocks := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, block, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Bad cidr. Got %v", err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	blocks, err := parseCIDRs(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return blocks
+}
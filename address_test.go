@@ -0,0 +1,77 @@
+package platform_test
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+var _ = Describe("SelectAddress", func() {
+	addr := func(iface, ip string) platform.InterfaceAddr {
+		return platform.InterfaceAddr{Interface: iface, IP: net.ParseIP(ip)}
+	}
+
+	var addrs []platform.InterfaceAddr
+
+	BeforeEach(func() {
+		addrs = []platform.InterfaceAddr{
+			addr("lo", "127.0.0.1"),
+			addr("docker0", "172.17.0.1"),
+			addr("eth0", "fe80::1"),
+			addr("eth0", "203.0.113.10"),
+			addr("eth0", "fd00::10"),
+			addr("eth1", "100.64.0.10"),
+			addr("eth2", "10.1.2.3"),
+		}
+	})
+
+	It("should skip bridges, loopback, link-local and public addresses", func() {
+		ip, err := platform.SelectAddress(addrs, platform.AddressOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("10.1.2.3"))
+	})
+
+	It("should consider shared address space and unique local IPv6 addresses private", func() {
+		ip, err := platform.SelectAddress(addrs, platform.AddressOptions{Interfaces: []string{"eth0", "eth1"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("100.64.0.10"))
+
+		ip, err = platform.SelectAddress(addrs, platform.AddressOptions{Interfaces: []string{"eth0"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("fd00::10"))
+
+		ip, err = platform.SelectAddress(addrs, platform.AddressOptions{PreferIPv6: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("fd00::10"))
+	})
+
+	It("should honor interface patterns and exclusions", func() {
+		ip, err := platform.SelectAddress(addrs, platform.AddressOptions{Interfaces: []string{"docker*"}, ExcludeInterfaces: []string{}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("172.17.0.1"))
+
+		ip, err = platform.SelectAddress(addrs, platform.AddressOptions{ExcludeInterfaces: []string{"docker*", "eth2"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("100.64.0.10"))
+	})
+
+	It("should rank addresses by the preferred blocks", func() {
+		ip, err := platform.SelectAddress(addrs, platform.AddressOptions{Prefer: []string{"100.64.0.0/10", "10.0.0.0/8"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("100.64.0.10"))
+
+		ip, err = platform.SelectAddress(addrs, platform.AddressOptions{Prefer: []string{"203.0.113.0/24"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("203.0.113.10"))
+
+		_, err = platform.SelectAddress(addrs, platform.AddressOptions{Prefer: []string{"10.0.0.0"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail when no address qualifies", func() {
+		_, err := platform.SelectAddress(addrs[:4], platform.AddressOptions{})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,515 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	"github.com/hashicorp/hcl"
+	"gopkg.in/bluesuncorp/validator.v5"
+)
+
+const (
+	// How long a single blocking query waits for a change. Backends may
+	// clamp this to stay under their request timeout.
+	defaultWatchWait = 10 * time.Second
+
+	// Upper bound for the delay between failed watch attempts
+	defaultMaxBackoff = 30 * time.Second
+
+	// Delay before watching again when the store returned an index it
+	// cannot block on
+	defaultIdleWait = time.Second
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+var (
+	ErrInvalidDefaults = errors.New("config defaults must be a pointer to a struct")
+	ErrInvalidPrefix   = errors.New("config prefix must not be blank or begin with a slash")
+	ErrAlreadyStarted  = errors.New("config watcher already started")
+)
+
+// Validator may be implemented by config structs to check invariants the
+// validate tags cannot express. It is called after tag validation.
+type Validator interface {
+	Validate() error
+}
+
+// ChangeFunc is called with the previous and the new config after a new
+// version has been swapped in. Both are pointers to the config struct.
+type ChangeFunc func(old, new interface{})
+
+// Watcher binds the keys under a KV prefix into a typed struct and keeps it
+// up to date. Keys below the prefix map onto struct fields by path, so
+// "myapp/timeouts/read" sets the Read field of the Timeouts field. Each value
+// may be JSON, HCL or a plain string; values of string fields are always
+// taken as is. Fields missing from the store keep the value they have in the
+// defaults.
+type Watcher struct {
+	kv        registry.KV
+	prefix    string
+	typ       reflect.Type
+	defaults  []byte
+	validate  *validator.Validate
+	current   atomic.Value
+	lastError error
+	callbacks []ChangeFunc
+	started   bool
+	quit      chan struct{}
+	mtx       *sync.Mutex
+}
+
+// New creates a watcher for the keys under prefix. defaults must be a pointer
+// to the config struct; it is used as the starting point for every version
+// and as the current config until Start loads the store.
+func New(kv registry.KV, prefix string, defaults interface{}) (*Watcher, error) {
+	t := reflect.TypeOf(defaults)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct || reflect.ValueOf(defaults).IsNil() {
+		return nil, ErrInvalidDefaults
+	}
+
+	if prefix == "" || strings.HasPrefix(prefix, "/") {
+		return nil, ErrInvalidPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	raw, err := json.Marshal(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode config defaults: %v", err)
+	}
+
+	w := &Watcher{
+		kv:       kv,
+		prefix:   prefix,
+		typ:      t.Elem(),
+		defaults: raw,
+		validate: validator.New("validate", validator.BakedInValidators),
+		mtx:      &sync.Mutex{},
+	}
+
+	initial, err := w.decode(nil)
+	if err != nil {
+		return nil, err
+	}
+	w.current.Store(initial)
+
+	return w, nil
+}
+
+// Load returns the current config as a pointer to the config struct. The
+// value is shared between callers and must not be modified.
+func (w *Watcher) Load() interface{} {
+	return w.current.Load()
+}
+
+// OnChange registers fn to be called every time a new version is applied.
+func (w *Watcher) OnChange(fn ChangeFunc) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.callbacks = append(w.callbacks, fn)
+}
+
+// LastError returns the error from the most recent watch or load attempt, or
+// nil if it succeeded. A version that fails to decode or validate is
+// reported here and the previous config is kept.
+func (w *Watcher) LastError() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.lastError
+}
+
+// Start loads the current version from the store and then watches the prefix
+// for changes until Stop is called. If the initial version cannot be read or
+// is invalid the watcher is not started.
+func (w *Watcher) Start() error {
+	w.mtx.Lock()
+	if w.started {
+		w.mtx.Unlock()
+		return ErrAlreadyStarted
+	}
+	w.mtx.Unlock()
+
+	pairs, index, err := w.kv.WatchList(w.prefix, 0, defaultWatchWait)
+	if err != nil {
+		w.setError(err)
+		return err
+	}
+
+	err = w.apply(pairs)
+	if err != nil {
+		return err
+	}
+
+	w.mtx.Lock()
+	w.started = true
+	w.quit = make(chan struct{})
+	w.mtx.Unlock()
+
+	platform.Logger.Infof("watching config under %s", w.prefix)
+	go w.watch(index, w.quit)
+	return nil
+}
+
+// Stop ends the watch. A blocking query already in flight is abandoned.
+func (w *Watcher) Stop() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if !w.started {
+		return
+	}
+	close(w.quit)
+	w.started = false
+}
+
+func (w *Watcher) watch(index uint64, quit chan struct{}) {
+	var backoff time.Duration
+
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		pairs, next, err := w.kv.WatchList(w.prefix, index, defaultWatchWait)
+
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		if err != nil {
+			w.setError(err)
+
+			if backoff == 0 {
+				backoff = time.Second
+			} else {
+				backoff *= 2
+			}
+			if backoff > defaultMaxBackoff {
+				backoff = defaultMaxBackoff
+			}
+			platform.Logger.Infof("unable to watch config under %s, retrying in %v: %s", w.prefix, backoff, err)
+
+			select {
+			case <-time.After(backoff):
+			case <-quit:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if next == 0 {
+			// watching again with a zero index would return right away
+			select {
+			case <-time.After(defaultIdleWait):
+			case <-quit:
+				return
+			}
+		}
+
+		if next < index {
+			// the store was reset, so start over from a fresh read
+			index = 0
+			continue
+		}
+		if next == index {
+			continue
+		}
+		index = next
+
+		w.apply(pairs)
+	}
+}
+
+// apply decodes and validates pairs and swaps the result in if it differs from
+// the current config.
+func (w *Watcher) apply(pairs []*registry.KVPair) error {
+	next, err := w.decode(pairs)
+	if err != nil {
+		platform.Logger.Warnf("rejected config under %s: %s", w.prefix, err)
+		w.setError(err)
+		return err
+	}
+	w.setError(nil)
+
+	old := w.current.Load()
+	if reflect.DeepEqual(old, next) {
+		return nil
+	}
+
+	w.current.Store(next)
+	platform.Logger.Infof("applied new config under %s", w.prefix)
+
+	w.mtx.Lock()
+	callbacks := make([]ChangeFunc, len(w.callbacks))
+	copy(callbacks, w.callbacks)
+	w.mtx.Unlock()
+
+	for _, fn := range callbacks {
+		fn(old, next)
+	}
+	return nil
+}
+
+func (w *Watcher) setError(err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.lastError = err
+}
+
+// decode builds a new config struct from the defaults overlaid with pairs and
+// validates it.
+func (w *Watcher) decode(pairs []*registry.KVPair) (interface{}, error) {
+	doc := make(map[string]interface{})
+	for _, p := range pairs {
+		path := strings.TrimPrefix(p.Key, w.prefix)
+		if path == "" || strings.HasSuffix(path, "/") {
+			// folder placeholder
+			continue
+		}
+
+		names := strings.Split(path, "/")
+		err := set(doc, names, decodeValue(p.Value, typeAt(w.typ, names)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Key, err)
+		}
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	out := reflect.New(w.typ).Interface()
+	err = json.Unmarshal(w.defaults, out)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, out)
+	if err != nil {
+		return nil, err
+	}
+
+	// Struct returns a *StructErrors, so check it before it becomes an error
+	if errs := w.validate.Struct(out); errs != nil {
+		return nil, errs
+	}
+	if v, ok := out.(Validator); ok {
+		err = v.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// decodeValue decodes a stored value against the type of the field it sets,
+// or nil if no field matches. String fields take the value as is and
+// time.Duration fields also accept a value such as "30s". Anything else is
+// read as JSON, then as HCL, and otherwise kept as a string. The HCL parser
+// accepts a lone word as an object key, so only values with an assignment or
+// a block are treated as HCL.
+func decodeValue(raw []byte, t reflect.Type) interface{} {
+	t = indirect(t)
+	if t != nil && t.Kind() == reflect.String {
+		return string(raw)
+	}
+
+	s := strings.TrimSpace(string(raw))
+	if s == "" {
+		return string(raw)
+	}
+
+	var v interface{}
+	if json.Unmarshal(raw, &v) == nil {
+		return coerce(v, t)
+	}
+
+	m := make(map[string]interface{})
+	if strings.ContainsAny(s, "={") && hcl.Decode(&m, s) == nil {
+		return coerce(flattenHCL(m), t)
+	}
+
+	return coerce(string(raw), t)
+}
+
+// coerce converts the durations written as strings within v into the
+// nanoseconds time.Duration decodes from.
+func coerce(v interface{}, t reflect.Type) interface{} {
+	t = indirect(t)
+	if t == nil {
+		return v
+	}
+
+	switch {
+	case t == durationType:
+		if s, ok := v.(string); ok {
+			if d, err := time.ParseDuration(strings.TrimSpace(s)); err == nil {
+				return int64(d)
+			}
+		}
+	case t.Kind() == reflect.Struct:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, e := range m {
+				m[k] = coerce(e, fieldType(t, k))
+			}
+		}
+	case t.Kind() == reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, e := range m {
+				m[k] = coerce(e, t.Elem())
+			}
+		}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		if l, ok := v.([]interface{}); ok {
+			for i, e := range l {
+				l[i] = coerce(e, t.Elem())
+			}
+		}
+	}
+	return v
+}
+
+// typeAt returns the type of the field a key path sets, or nil if there is
+// none.
+func typeAt(t reflect.Type, path []string) reflect.Type {
+	for _, name := range path {
+		t = indirect(t)
+		if t == nil {
+			return nil
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			t = fieldType(t, name)
+		case reflect.Map:
+			t = t.Elem()
+		default:
+			return nil
+		}
+	}
+	return t
+}
+
+// fieldType returns the type of the field of struct t that encoding/json
+// would decode name into, or nil if there is none.
+func fieldType(t reflect.Type, name string) reflect.Type {
+	var folded reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" && f.Anonymous && indirect(f.Type).Kind() == reflect.Struct {
+			if ft := fieldType(indirect(f.Type), name); ft != nil {
+				return ft
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		key := f.Name
+		if tag != "" {
+			key = tag
+		}
+
+		if key == name {
+			return f.Type
+		}
+		if folded == nil && strings.EqualFold(key, name) {
+			folded = f.Type
+		}
+	}
+	return folded
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// flattenHCL collapses the single element lists HCL decodes blocks into, so
+// they line up with the JSON form of the same document.
+func flattenHCL(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []map[string]interface{}:
+		if len(t) == 1 {
+			return flattenHCL(t[0])
+		}
+		out := make([]interface{}, 0, len(t))
+		for _, m := range t {
+			out = append(out, flattenHCL(m))
+		}
+		return out
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = flattenHCL(e)
+		}
+		return t
+	case []interface{}:
+		for i, e := range t {
+			t[i] = flattenHCL(e)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func set(doc map[string]interface{}, path []string, value interface{}) error {
+	for _, name := range path[:len(path)-1] {
+		next, ok := doc[name]
+		if !ok {
+			m := make(map[string]interface{})
+			doc[name] = m
+			doc = m
+			continue
+		}
+		m, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not an object", name)
+		}
+		doc = m
+	}
+
+	name := path[len(path)-1]
+	if existing, ok := doc[name].(map[string]interface{}); ok {
+		if m, ok := value.(map[string]interface{}); ok {
+			merge(existing, m)
+			return nil
+		}
+	}
+	doc[name] = value
+	return nil
+}
+
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		existing, ok := dst[k].(map[string]interface{})
+		m, isMap := v.(map[string]interface{})
+		if ok && isMap {
+			merge(existing, m)
+			continue
+		}
+		dst[k] = v
+	}
+}
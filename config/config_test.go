@@ -0,0 +1,212 @@
+package config_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/config"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type timeouts struct {
+	Read  config.Duration
+	Write config.Duration
+	Idle  time.Duration
+}
+
+type appConfig struct {
+	Name     string `validate:"required"`
+	Port     string
+	Version  string
+	Mode     string
+	Workers  int `validate:"min=1"`
+	Beta     bool
+	Interval time.Duration
+	Timeouts timeouts
+	Limits   map[string]int
+}
+
+func (c *appConfig) Validate() error {
+	if c.Timeouts.Write.Duration < c.Timeouts.Read.Duration {
+		return errors.New("write timeout must not be shorter than read timeout")
+	}
+	return nil
+}
+
+// countingKV counts blocking queries, optionally losing the index the store
+// returned.
+type countingKV struct {
+	registry.KV
+	zeroIndex bool
+	calls     int32
+}
+
+func (c *countingKV) WatchList(prefix string, index uint64, wait time.Duration) ([]*registry.KVPair, uint64, error) {
+	atomic.AddInt32(&c.calls, 1)
+	pairs, next, err := c.KV.WatchList(prefix, index, wait)
+	if c.zeroIndex {
+		next = 0
+	}
+	return pairs, next, err
+}
+
+var _ = Describe("Config", func() {
+	var kv registry.KV
+	var defaults *appConfig
+
+	BeforeEach(func() {
+		var err error
+		kv, err = registry.NewKV(registry.NewMemoryAdapter())
+		Expect(err).ToNot(HaveOccurred())
+
+		defaults = &appConfig{
+			Name:     "bifrost",
+			Workers:  2,
+			Timeouts: timeouts{Read: config.Duration{time.Second}, Write: config.Duration{time.Second}},
+		}
+	})
+
+	It("should require a pointer to a struct for defaults", func() {
+		_, err := config.New(kv, "bifrost", *defaults)
+		Expect(err).To(Equal(config.ErrInvalidDefaults))
+	})
+
+	It("should load the defaults when the prefix is empty", func() {
+		w, err := config.New(kv, "bifrost", defaults)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Start()).To(Succeed())
+		defer w.Stop()
+
+		Expect(w.Load()).To(Equal(defaults))
+	})
+
+	It("should bind JSON, HCL and plain values onto the struct", func() {
+		Expect(kv.Put("bifrost/name", []byte("heimdal"))).To(Succeed())
+		Expect(kv.Put("bifrost/workers", []byte("8"))).To(Succeed())
+		Expect(kv.Put("bifrost/beta", []byte("true"))).To(Succeed())
+		Expect(kv.Put("bifrost/timeouts/write", []byte(`"5s"`))).To(Succeed())
+		Expect(kv.Put("bifrost/limits", []byte("calls = 10\nsms = 5"))).To(Succeed())
+
+		w, err := config.New(kv, "bifrost", defaults)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Start()).To(Succeed())
+		defer w.Stop()
+
+		c := w.Load().(*appConfig)
+		Expect(c.Name).To(Equal("heimdal"))
+		Expect(c.Workers).To(Equal(8))
+		Expect(c.Beta).To(BeTrue())
+		Expect(c.Timeouts.Read.Duration).To(Equal(time.Second))
+		Expect(c.Timeouts.Write.Duration).To(Equal(5 * time.Second))
+		Expect(c.Limits).To(Equal(map[string]int{"calls": 10, "sms": 5}))
+	})
+
+	It("should decode values against the type of their field", func() {
+		Expect(kv.Put("bifrost/port", []byte("8080"))).To(Succeed())
+		Expect(kv.Put("bifrost/version", []byte("1.10"))).To(Succeed())
+		Expect(kv.Put("bifrost/mode", []byte("true"))).To(Succeed())
+		Expect(kv.Put("bifrost/interval", []byte("30s"))).To(Succeed())
+		Expect(kv.Put("bifrost/timeouts", []byte(`{"idle": "1m", "read": "2s", "write": "3s"}`))).To(Succeed())
+
+		w, err := config.New(kv, "bifrost", defaults)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Start()).To(Succeed())
+		defer w.Stop()
+
+		c := w.Load().(*appConfig)
+		Expect(c.Port).To(Equal("8080"))
+		Expect(c.Version).To(Equal("1.10"))
+		Expect(c.Mode).To(Equal("true"))
+		Expect(c.Interval).To(Equal(30 * time.Second))
+		Expect(c.Timeouts.Idle).To(Equal(time.Minute))
+		Expect(c.Timeouts.Read.Duration).To(Equal(2 * time.Second))
+		Expect(c.Timeouts.Write.Duration).To(Equal(3 * time.Second))
+
+		Expect(kv.Put("bifrost/interval", []byte(`"45s"`))).To(Succeed())
+		Eventually(func() time.Duration {
+			return w.Load().(*appConfig).Interval
+		}).Should(Equal(45 * time.Second))
+	})
+
+	It("should not start on an invalid config", func() {
+		Expect(kv.Put("bifrost/workers", []byte("0"))).To(Succeed())
+
+		w, err := config.New(kv, "bifrost", defaults)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Start()).ToNot(Succeed())
+		Expect(w.LastError()).To(HaveOccurred())
+	})
+
+	Context("watching", func() {
+		var w *config.Watcher
+
+		BeforeEach(func() {
+			var err error
+			w, err = config.New(kv, "bifrost", defaults)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Start()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			w.Stop()
+		})
+
+		It("should swap in new versions and notify callbacks", func() {
+			changes := make(chan [2]*appConfig, 1)
+			w.OnChange(func(old, new interface{}) {
+				changes <- [2]*appConfig{old.(*appConfig), new.(*appConfig)}
+			})
+
+			Expect(kv.Put("bifrost/workers", []byte("4"))).To(Succeed())
+
+			var change [2]*appConfig
+			Eventually(changes).Should(Receive(&change))
+			Expect(change[0].Workers).To(Equal(2))
+			Expect(change[1].Workers).To(Equal(4))
+			Expect(w.Load().(*appConfig).Workers).To(Equal(4))
+		})
+
+		It("should keep the current version when a new one fails validation", func() {
+			Expect(kv.Put("bifrost/timeouts/write", []byte("100ms"))).To(Succeed())
+
+			Eventually(w.LastError).Should(HaveOccurred())
+			Expect(w.Load()).To(Equal(defaults))
+
+			Expect(kv.Put("bifrost/timeouts/write", []byte("2s"))).To(Succeed())
+
+			Eventually(w.LastError).ShouldNot(HaveOccurred())
+			Eventually(func() time.Duration {
+				return w.Load().(*appConfig).Timeouts.Write.Duration
+			}).Should(Equal(2 * time.Second))
+		})
+
+		It("should not notify callbacks when writes leave the config unchanged", func() {
+			calls := make(chan struct{}, 10)
+			w.OnChange(func(old, new interface{}) {
+				calls <- struct{}{}
+			})
+
+			Expect(kv.Put("bifrost/workers", []byte("2"))).To(Succeed())
+			Expect(kv.Put("unrelated/key", []byte("x"))).To(Succeed())
+
+			Consistently(calls, 200*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	It("should block while the prefix is idle", func() {
+		for _, zeroIndex := range []bool{false, true} {
+			counting := &countingKV{KV: kv, zeroIndex: zeroIndex}
+			w, err := config.New(counting, "bifrost", defaults)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Start()).To(Succeed())
+
+			calls := func() int32 { return atomic.LoadInt32(&counting.calls) }
+			Consistently(calls, 200*time.Millisecond).Should(BeNumerically("<=", 2))
+			w.Stop()
+		}
+	})
+})
@@ -1,24 +1,42 @@
 package consul
 
 import (
-	"fmt"
 	"net/url"
+	"reflect"
+	"sync"
 	"time"
 
-	consul_api "github.com/hashicorp/consul/api"
 	"gitlab.vailsys.com/vail-cloud-services/platform"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
 )
 
+// PublisherOptions configures optional publisher behaviour.
+type PublisherOptions struct {
+	// SnapshotDir is where the last healthy endpoint set of the service is
+	// persisted. At startup the publisher publishes the snapshot, marked
+	// stale, until the registry answers. Empty disables snapshots.
+	SnapshotDir string
+}
+
 type ConsulPublisher struct {
 	subscribe     chan chan<- []*url.URL
 	unsubscribe   chan chan<- []*url.URL
 	quit          chan struct{}
 	ErrChan       chan error
 	consulAdapter registry.RegistryAdapter
+	snapshot      string
+	saved         []string
+	stale         bool
+	mtx           *sync.Mutex
 }
 
 func NewConsulPublisher(consul registry.RegistryAdapter, name string, ttl time.Duration) *ConsulPublisher {
+	return NewConsulPublisherWithOptions(consul, name, ttl, PublisherOptions{})
+}
+
+// NewConsulPublisherWithOptions returns a publisher of the healthy instances
+// of name, refreshed every ttl, configured by opts.
+func NewConsulPublisherWithOptions(consul registry.RegistryAdapter, name string, ttl time.Duration, opts PublisherOptions) *ConsulPublisher {
 	if name == "" {
 		panic("name cannot be nil")
 	}
@@ -32,6 +50,10 @@ func NewConsulPublisher(consul registry.RegistryAdapter, name string, ttl time.D
 		quit:          make(chan struct{}),
 		ErrChan:       make(chan error),
 		consulAdapter: consul,
+		mtx:           &sync.Mutex{},
+	}
+	if opts.SnapshotDir != "" {
+		p.snapshot = snapshotPath(opts.SnapshotDir, name)
 	}
 
 	go p.loop(name, ttl)
@@ -51,21 +73,21 @@ func (p *ConsulPublisher) Stop() {
 	close(p.quit)
 }
 
+// Stale reports whether the published endpoints come from the snapshot and
+// have not been confirmed by the registry yet.
+func (p *ConsulPublisher) Stale() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.stale
+}
+
 var newTicker = time.NewTicker
 
 func (p *ConsulPublisher) loop(name string, ttl time.Duration) {
 	platform.Logger.Debugf("consul publisher %s with ttl %v", name, ttl)
 
 	subscriptions := map[chan<- []*url.URL]struct{}{}
-	service, err := p.fetch(name)
-
-	var urls []*url.URL
-
-	if err == nil {
-		urls = format(service)
-	} else {
-		urls = make([]*url.URL, 0)
-	}
+	urls := p.refresh(name, p.restore(name))
 
 	platform.Logger.Debugf("found urls: %s", urls)
 
@@ -77,13 +99,7 @@ func (p *ConsulPublisher) loop(name string, ttl time.Duration) {
 		case <-ticker.C:
 			platform.Logger.Debugf("discovery check ticked")
 
-			service, err := p.fetch(name)
-			if err != nil {
-				//p.ErrChan <- err
-				urls = make([]*url.URL, 0)
-			} else {
-				urls = format(service)
-			}
+			urls = p.refresh(name, urls)
 			platform.Logger.Debugf("broadcasting urls: %s", urls)
 			for c := range subscriptions {
 				c <- urls
@@ -102,7 +118,78 @@ func (p *ConsulPublisher) loop(name string, ttl time.Duration) {
 	}
 }
 
-func (p *ConsulPublisher) fetch(name string) ([]*consul_api.ServiceEntry, error) {
+// refresh returns the healthy instances of name. While the snapshot has not
+// been confirmed, a fetch failing to reach the registry keeps publishing last
+// rather than nothing. A registry answering that the service does not exist
+// confirms that it has no endpoints.
+func (p *ConsulPublisher) refresh(name string, last []*url.URL) []*url.URL {
+	service, err := p.fetch(name)
+	if err == registry.ErrServiceNotFound {
+		// the registry answered: the service has no instances left
+		service, err = nil, nil
+	}
+	if err != nil {
+		if p.Stale() {
+			return last
+		}
+		return make([]*url.URL, 0)
+	}
+
+	urls := format(service)
+	if p.Stale() {
+		platform.Logger.Infof("registry confirmed the endpoints of %s", name)
+		p.setStale(false)
+	}
+	p.persist(name, urls)
+	return urls
+}
+
+// restore loads the snapshot of name, marking the publisher stale if there
+// is one.
+func (p *ConsulPublisher) restore(name string) []*url.URL {
+	if p.snapshot == "" {
+		return nil
+	}
+
+	urls, err := loadSnapshot(p.snapshot)
+	if err != nil {
+		platform.Logger.Debugf("no discovery snapshot for %s: %s", name, err)
+		return nil
+	}
+
+	platform.Logger.Infof("loaded %d stale endpoints of %s from %s", len(urls), name, p.snapshot)
+	p.saved = urlStrings(urls)
+	p.setStale(true)
+	return urls
+}
+
+// persist saves urls as the snapshot of name when they changed. An empty
+// set is not saved so that the last good one survives.
+func (p *ConsulPublisher) persist(name string, urls []*url.URL) {
+	if p.snapshot == "" || len(urls) == 0 {
+		return
+	}
+
+	current := urlStrings(urls)
+	if reflect.DeepEqual(current, p.saved) {
+		return
+	}
+
+	err := saveSnapshot(p.snapshot, name, current)
+	if err != nil {
+		platform.Logger.Warnf("unable to save discovery snapshot of %s: %s", name, err)
+		return
+	}
+	p.saved = current
+}
+
+func (p *ConsulPublisher) setStale(val bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.stale = val
+}
+
+func (p *ConsulPublisher) fetch(name string) ([]*registry.HealthEntry, error) {
 	err := p.consulAdapter.Ping()
 	if err != nil {
 		return nil, err
@@ -117,7 +204,7 @@ func (p *ConsulPublisher) fetch(name string) ([]*consul_api.ServiceEntry, error)
 	return serv, nil
 }
 
-func format(serviceEntry []*consul_api.ServiceEntry) []*url.URL {
+func format(serviceEntry []*registry.HealthEntry) []*url.URL {
 	urls := make([]*url.URL, 0)
 
 	if len(serviceEntry) == 0 {
@@ -126,8 +213,8 @@ func format(serviceEntry []*consul_api.ServiceEntry) []*url.URL {
 
 	for _, service := range serviceEntry {
 		url := &url.URL{
-			Scheme: "http",
-			Host:   fmt.Sprintf("%s:%d", service.Service.Address, service.Service.Port),
+			Scheme: service.Instance.Scheme(),
+			Host:   service.Instance.HostPort(),
 		}
 		urls = append(urls, url)
 	}
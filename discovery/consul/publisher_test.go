@@ -2,13 +2,16 @@ package consul_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	consul_api "github.com/hashicorp/consul/api"
 	"gitlab.vailsys.com/vail-cloud-services/platform/discovery/consul"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
@@ -53,21 +56,21 @@ var _ = Describe("consul discovery publisher", func() {
 	})
 
 	It("subscriptions should receive the name of the service", func() {
-		service := &consul_api.AgentService{
-			Service: "service",
+		service := &registry.Instance{
+			Name:    "service",
 			Address: "127.0.0.1",
 			Port:    3000,
 		}
-		entry := []*consul_api.ServiceEntry{
-			&consul_api.ServiceEntry{
-				Service: service,
+		entry := []*registry.HealthEntry{
+			&registry.HealthEntry{
+				Instance: service,
 			},
 		}
 
 		fakeAdapter.PingReturns(nil)
 		fakeAdapter.CheckServiceReturns(entry, nil)
 
-		p := consul.NewConsulPublisher(fakeAdapter, service.Service, 1*time.Second)
+		p := consul.NewConsulPublisher(fakeAdapter, service.Name, 1*time.Second)
 		defer p.Stop()
 
 		c := make(chan []*url.URL)
@@ -77,6 +80,148 @@ var _ = Describe("consul discovery publisher", func() {
 		Eventually(c).Should(Receive())
 	})
 
+	It("should publish ipv6 and node addresses as valid hosts", func() {
+		adapter := new(fakes.FakeRegistryAdapter)
+		adapter.CheckServiceReturns([]*registry.HealthEntry{
+			&registry.HealthEntry{Instance: &registry.Instance{Name: "service", Address: "fd00::5", Port: 3000}},
+			&registry.HealthEntry{Instance: &registry.Instance{Name: "service", NodeAddress: "10.0.0.7", Port: 3001}},
+		}, nil)
+
+		p := consul.NewConsulPublisher(adapter, "service", 1*time.Second)
+		defer p.Stop()
+
+		c := make(chan []*url.URL)
+		p.Subscribe(c)
+		defer p.Unsubscribe(c)
+
+		var urls []*url.URL
+		Eventually(c).Should(Receive(&urls))
+		Expect(urls).To(HaveLen(2))
+		Expect(urls[0].String()).To(Equal("http://[fd00::5]:3000"))
+		Expect(urls[1].String()).To(Equal("http://10.0.0.7:3001"))
+	})
+
+	Context("with a snapshot dir", func() {
+		var dir string
+
+		entry := func(port int) []*registry.HealthEntry {
+			return []*registry.HealthEntry{
+				&registry.HealthEntry{Instance: &registry.Instance{Name: "snapshotted", Address: "127.0.0.1", Port: port}},
+			}
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "publisher")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should publish the stale snapshot until consul confirms the endpoints", func() {
+			opts := consul.PublisherOptions{SnapshotDir: dir}
+
+			// the fake's Returns setters are not synchronized, so drive it
+			// through stubs reading state guarded by a mutex
+			var mtx sync.Mutex
+			var pingErr error
+			entries := entry(3000)
+			adapter := new(fakes.FakeRegistryAdapter)
+			adapter.PingStub = func() error {
+				mtx.Lock()
+				defer mtx.Unlock()
+				return pingErr
+			}
+			adapter.CheckServiceStub = func(string, string, bool) ([]*registry.HealthEntry, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				return entries, nil
+			}
+
+			p := consul.NewConsulPublisherWithOptions(adapter, "snapshotted", 100*time.Millisecond, opts)
+			c := make(chan []*url.URL)
+			p.Subscribe(c)
+			Eventually(c).Should(Receive())
+			Expect(p.Stale()).To(BeFalse())
+			Eventually(filepath.Join(dir, "snapshotted.json")).Should(BeAnExistingFile())
+			p.Unsubscribe(c)
+			p.Stop()
+
+			// restarted while consul is down
+			mtx.Lock()
+			pingErr = fmt.Errorf("consul is down")
+			mtx.Unlock()
+
+			p = consul.NewConsulPublisherWithOptions(adapter, "snapshotted", 100*time.Millisecond, opts)
+			defer p.Stop()
+			c = make(chan []*url.URL)
+			p.Subscribe(c)
+			defer p.Unsubscribe(c)
+
+			var urls []*url.URL
+			Eventually(c).Should(Receive(&urls))
+			Expect(urls).To(HaveLen(1))
+			Expect(urls[0].Host).To(Equal("127.0.0.1:3000"))
+			Expect(p.Stale()).To(BeTrue())
+
+			Eventually(c).Should(Receive(&urls))
+			Expect(urls).To(HaveLen(1))
+
+			mtx.Lock()
+			pingErr = nil
+			entries = entry(3001)
+			mtx.Unlock()
+
+			Eventually(func() string {
+				urls := <-c
+				if len(urls) != 1 {
+					return ""
+				}
+				return urls[0].Host
+			}).Should(Equal("127.0.0.1:3001"))
+			Expect(p.Stale()).To(BeFalse())
+
+			Eventually(func() string {
+				data, _ := ioutil.ReadFile(filepath.Join(dir, "snapshotted.json"))
+				return string(data)
+			}).Should(ContainSubstring("127.0.0.1:3001"))
+		})
+
+		It("should drop the stale snapshot once the registry says the service is gone", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "snapshotted.json"), []byte(`{"service":"snapshotted","urls":["http://127.0.0.1:3000"]}`), 0600)).To(Succeed())
+
+			adapter := new(fakes.FakeRegistryAdapter)
+			adapter.CheckServiceReturns(nil, registry.ErrServiceNotFound)
+
+			p := consul.NewConsulPublisherWithOptions(adapter, "snapshotted", 100*time.Millisecond, consul.PublisherOptions{SnapshotDir: dir})
+			defer p.Stop()
+			c := make(chan []*url.URL)
+			p.Subscribe(c)
+			defer p.Unsubscribe(c)
+
+			Eventually(func() int { return len(<-c) }).Should(Equal(0))
+			Expect(p.Stale()).To(BeFalse())
+		})
+
+		It("should start empty without a snapshot", func() {
+			adapter := new(fakes.FakeRegistryAdapter)
+			adapter.PingReturns(fmt.Errorf("consul is down"))
+
+			p := consul.NewConsulPublisherWithOptions(adapter, "snapshotted", 100*time.Millisecond, consul.PublisherOptions{SnapshotDir: dir})
+			defer p.Stop()
+			c := make(chan []*url.URL)
+			p.Subscribe(c)
+			defer p.Unsubscribe(c)
+
+			var urls []*url.URL
+			Eventually(c).Should(Receive(&urls))
+			Expect(urls).To(BeEmpty())
+			Expect(p.Stale()).To(BeFalse())
+		})
+	})
+
 	const TIMEOUT = 3 * time.Second
 	Context("running consul cluster", func() {
 		var r registry.RegistryAdapter
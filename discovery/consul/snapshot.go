@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the last healthy endpoint set of a service as written to disk.
+type snapshot struct {
+	Service string    `json:"service"`
+	Updated time.Time `json:"updated"`
+	URLs    []string  `json:"urls"`
+}
+
+// snapshotPath returns the file holding the snapshot of the named service.
+func snapshotPath(dir, name string) string {
+	return filepath.Join(dir, url.PathEscape(name)+".json")
+}
+
+func loadSnapshot(path string) ([]*url.URL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap snapshot
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]*url.URL, 0, len(snap.URLs))
+	for _, raw := range snap.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// saveSnapshot writes the snapshot to a temporary file first so that a crash
+// never leaves a truncated snapshot behind.
+func saveSnapshot(path, name string, urls []string) error {
+	data, err := json.Marshal(snapshot{Service: name, Updated: time.Now(), URLs: urls})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func urlStrings(urls []*url.URL) []string {
+	s := make([]string, 0, len(urls))
+	for _, u := range urls {
+		s = append(s, u.String())
+	}
+	return s
+}
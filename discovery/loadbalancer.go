@@ -11,4 +11,11 @@ type LoadBalancer interface {
 	Stop()
 }
 
+// EndpointLister is implemented by load balancers that can list the
+// endpoints they pick from and report whether those are stale.
+type EndpointLister interface {
+	Endpoints() []*url.URL
+	Stale() bool
+}
+
 var ErrNoEndpointsAvailable = errors.New("no endpoints available")
@@ -7,3 +7,10 @@ type Publisher interface {
 	Unsubscribe(chan<- []*url.URL)
 	Stop()
 }
+
+// StalePublisher is implemented by publishers that may publish endpoints the
+// registry has not confirmed yet, such as a snapshot loaded at startup.
+type StalePublisher interface {
+	Publisher
+	Stale() bool
+}
@@ -6,12 +6,13 @@ import (
 )
 
 func RoundRobin(p Publisher) LoadBalancer {
-	return &roundRobin{newCache(p), 0}
+	return &roundRobin{newCache(p), 0, p}
 }
 
 type roundRobin struct {
 	*cache
 	uint64
+	publisher Publisher
 }
 
 func (r *roundRobin) Count() int { return r.cache.count() }
@@ -32,6 +33,18 @@ func (r *roundRobin) Get() (*url.URL, error) {
 	return endpoints[old%uint64(len(endpoints))], nil
 }
 
+// Endpoints returns a copy of the endpoints currently balanced between.
+func (r *roundRobin) Endpoints() []*url.URL {
+	endpoints := r.cache.get()
+	return append([]*url.URL(nil), endpoints...)
+}
+
+// Stale reports whether the endpoints are not confirmed by the registry.
+func (r *roundRobin) Stale() bool {
+	p, ok := r.publisher.(StalePublisher)
+	return ok && p.Stale()
+}
+
 func (r *roundRobin) Stop() {
 	r.cache.stop()
 }
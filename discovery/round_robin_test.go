@@ -7,10 +7,10 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	consul_api "github.com/hashicorp/consul/api"
 	"gitlab.vailsys.com/vail-cloud-services/platform/discovery"
 	"gitlab.vailsys.com/vail-cloud-services/platform/discovery/consul"
 	"gitlab.vailsys.com/vail-cloud-services/platform/discovery/static"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
 )
 
@@ -21,17 +21,17 @@ var _ = Describe("round robin", func() {
 		//var service = "fakeservice"
 
 		It("should provide an error when the service nis not avaible", func() {
-			service := &consul_api.AgentService{
-				Service: "service",
+			service := &registry.Instance{
+				Name:    "service",
 				Address: "127.0.0.1",
 				Port:    3000,
 			}
-			entry := []*consul_api.ServiceEntry{}
+			entry := []*registry.HealthEntry{}
 
 			fakeAdapter.PingReturns(nil)
 			fakeAdapter.CheckServiceReturns(entry, nil)
 
-			publisher := consul.NewConsulPublisher(fakeAdapter, service.Service, 5*time.Second)
+			publisher := consul.NewConsulPublisher(fakeAdapter, service.Name, 5*time.Second)
 			defer publisher.Stop()
 
 			rb := discovery.RoundRobin(publisher)
@@ -44,45 +44,30 @@ var _ = Describe("round robin", func() {
 		})
 
 		It("should provide urls in a roundrobin fashion", func() {
-			service := &consul_api.AgentService{
-				Service: "service",
+			service := &registry.Instance{
+				Name:    "service",
 				Address: "127.0.0.1",
 				Port:    3000,
 			}
-			service2 := &consul_api.AgentService{
-				Service: "service",
+			service2 := &registry.Instance{
+				Name:    "service",
 				Address: "127.0.0.2",
 				Port:    3000,
 			}
 
-			entry := []*consul_api.ServiceEntry{
-				&consul_api.ServiceEntry{
-					Service: service,
+			entry := []*registry.HealthEntry{
+				&registry.HealthEntry{
+					Instance: service,
 				},
-				&consul_api.ServiceEntry{
-					Service: service2,
+				&registry.HealthEntry{
+					Instance: service2,
 				},
 			}
 
-			//nodes := []*registry.Node{
-			//&registry.Node{&api.CatalogService{
-			//ServiceAddress: "192.168.1.1",
-			//Address:        "localhost",
-			//ServicePort:    3001,
-			//}},
-			//&registry.Node{&api.CatalogService{
-			//Address:        "localhost",
-			//ServiceAddress: "192.168.1.2",
-			//ServicePort:    3001,
-			//}},
-			//}
-
-			//service := &registry.VailService{Name: service, Nodes: nodes}
-
 			fakeAdapter.PingReturns(nil)
 			fakeAdapter.CheckServiceReturns(entry, nil)
 
-			publisher := consul.NewConsulPublisher(fakeAdapter, service.Service, 5*time.Second)
+			publisher := consul.NewConsulPublisher(fakeAdapter, service.Name, 5*time.Second)
 			defer publisher.Stop()
 
 			rb := discovery.RoundRobin(publisher)
@@ -132,5 +117,19 @@ var _ = Describe("round robin", func() {
 			Expect(url.Host).To(Equal(endpoints[1].Host))
 
 		})
+
+		It("should list its endpoints", func() {
+			endpoints := []*url.URL{
+				&url.URL{Scheme: "http", Host: "127.0.0.1"},
+			}
+
+			lb := discovery.RoundRobin(static.NewStaticPublisher(endpoints))
+			defer lb.Stop()
+
+			lister, ok := lb.(discovery.EndpointLister)
+			Expect(ok).To(BeTrue())
+			Expect(lister.Endpoints()).To(Equal(endpoints))
+			Expect(lister.Stale()).To(BeFalse())
+		})
 	})
 })
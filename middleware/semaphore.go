@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"net/http"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+type semaphoreMiddleware struct {
+	sem *registry.Semaphore
+}
+
+// SemaphoreLimit only lets a request through while it holds a slot of sem,
+// so the routes it guards run at most sem's limit times at once across every
+// instance. Requests that find no free slot are rejected with a 429. The slot
+// is available to handlers under the "semaphoreSlot" key, and the request's
+// context is cancelled if the slot is lost before the handlers return.
+func SemaphoreLimit(sem *registry.Semaphore) *semaphoreMiddleware {
+	return &semaphoreMiddleware{sem: sem}
+}
+
+func (m *semaphoreMiddleware) GinFunc() gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		slot, err := m.sem.TryAcquire()
+
+		if err == registry.ErrNoSlots {
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": http.StatusTooManyRequests, "message": "too many concurrent requests"})
+			c.Abort()
+			return
+		}
+
+		if err != nil {
+			platform.Logger.Errorf("semaphore middleware returned error: %s", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": http.StatusServiceUnavailable, "message": "unable to acquire semaphore"})
+			c.Abort()
+			return
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		done := make(chan struct{})
+
+		defer slot.Release()
+		defer cancel()
+		defer close(done)
+
+		go watchSlot(c.Request.URL.Path, slot, cancel, done)
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Set("semaphoreSlot", slot)
+		c.Next()
+	}
+	return fn
+}
+
+// watchSlot cancels the request once its slot is lost, unless the request
+// is already done.
+func watchSlot(path string, slot *registry.Slot, cancel context.CancelFunc, done chan struct{}) {
+	select {
+	case <-slot.Lost():
+		select {
+		case <-done:
+			return
+		default:
+		}
+		platform.Logger.Warnf("semaphore slot lost while serving %s, cancelling the request", path)
+		cancel()
+	case <-done:
+	}
+}
@@ -0,0 +1,103 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.vailsys.com/vail-cloud-services/platform/middleware"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Semaphore Middleware", func() {
+	gin.SetMode("test")
+
+	It("should reject requests with a 429 while every slot is held", func() {
+		sem, err := registry.NewSemaphore(registry.NewMemoryAdapter(), "exports", 1, registry.LockOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		defer sem.Close()
+
+		entered := make(chan struct{})
+		release := make(chan struct{})
+
+		router := gin.New()
+		router.Use(middleware.SemaphoreLimit(sem).GinFunc())
+		router.GET("/export", func(c *gin.Context) {
+			_, ok := c.Get("semaphoreSlot")
+			Expect(ok).To(BeTrue())
+			entered <- struct{}{}
+			<-release
+			c.String(http.StatusOK, "done")
+		})
+
+		ts := httptest.NewServer(router)
+		defer ts.Close()
+
+		first := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			res, err := http.Get(ts.URL + "/export")
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			first <- res.StatusCode
+		}()
+
+		Eventually(entered).Should(Receive())
+
+		res, err := http.Get(ts.URL + "/export")
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusTooManyRequests))
+
+		close(release)
+		Eventually(first).Should(Receive(Equal(http.StatusOK)))
+
+		go func() {
+			<-entered
+		}()
+		res, err = http.Get(ts.URL + "/export")
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should cancel the request once its slot is lost", func() {
+		adapter := registry.NewMemoryAdapter()
+		sem, err := registry.NewSemaphore(adapter, "exports", 1, registry.LockOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		defer sem.Close()
+
+		entered := make(chan struct{})
+		cancelled := make(chan struct{})
+
+		router := gin.New()
+		router.Use(middleware.SemaphoreLimit(sem).GinFunc())
+		router.GET("/export", func(c *gin.Context) {
+			close(entered)
+			select {
+			case <-c.Request.Context().Done():
+				close(cancelled)
+			case <-time.After(5 * time.Second):
+			}
+			c.String(http.StatusOK, "done")
+		})
+
+		ts := httptest.NewServer(router)
+		defer ts.Close()
+
+		go func() {
+			defer GinkgoRecover()
+			res, err := http.Get(ts.URL + "/export")
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+		}()
+
+		Eventually(entered).Should(BeClosed())
+		Expect(adapter.Delete("exports/.lock")).To(Succeed())
+		Eventually(cancelled, 2*time.Second).Should(BeClosed())
+	})
+})
@@ -2,8 +2,14 @@ package registry
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/facebookgo/httpcontrol"
 
 	"gitlab.vailsys.com/vail-cloud-services/platform"
 	"gitlab.vailsys.com/vail-cloud-services/platform/heimdal"
@@ -15,32 +21,130 @@ const (
 	StatusDisconnected = 0
 	StatusConnected    = 1
 	CONSUL_TYPE        = "consul"
+	CONSUL_TLS_SCHEME  = "consuls"
 )
 
-func NewConsulAdapter(uri *url.URL) RegistryAdapter {
-	config := consul_api.DefaultConfig()
-	config.HttpClient = heimdal.DefaultHttpClient()
+// NewConsulAdapter returns an adapter for one or more consul agents. Calls go
+// to a single agent at a time and fail over to the next healthy agent when
+// the current one cannot be reached.
+func NewConsulAdapter(config Config, uris ...*url.URL) (RegistryAdapter, error) {
+	nodes := make([]*consulNode, 0, len(uris))
+
+	for _, uri := range uris {
+		cconfig, err := newConsulConfig(config, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := consul_api.NewClient(cconfig)
+		if err != nil {
+			return nil, fmt.Errorf("error creating consul adapter %s", err)
+		}
+		nodes = append(nodes, newConsulNode(cconfig.Address, client))
+	}
+
+	status := &AdapterStatus{
+		status: StatusDisconnected,
+		last:   StatusChange{From: StatusDisconnected, To: StatusDisconnected, Time: time.Now()},
+		queue:  &sync.Mutex{},
+	}
+
+	adapter := &ConsulAdapter{
+		nodes:           nodes,
+		registrations:   make(map[string]ServiceRegistration),
+		maintenance:     make(map[string]string),
+		ttl:             config.TTL(),
+		deregisterAfter: config.DeregisterCriticalAfter,
+		status:          status,
+		mtx:             &sync.Mutex{},
+	}
+	adapter.Ping()
+
+	return adapter, nil
+}
+
+// newConsulConfig builds the client configuration for a single agent. The
+// ACL token and TLS settings come from config and can be overridden per agent
+// with the token, token_file, ca, cert, key and tls_skip_verify URI query
+// parameters. The consuls scheme talks to the agent over https.
+func newConsulConfig(config Config, uri *url.URL) (*consul_api.Config, error) {
+	cconfig := consul_api.DefaultConfig()
+	client := heimdal.DefaultHttpClient()
+	cconfig.HttpClient = client
 
 	if uri.Host != "" {
-		config.Address = uri.Host
+		cconfig.Address = uri.Host
 	}
 
-	client, err := consul_api.NewClient(config)
-	if err != nil {
-		fmt.Printf("error creating consul adapter %s", err)
+	query := uri.Query()
+
+	token := config.Token
+	tokenFile := config.TokenFile
+	if v := query.Get("token"); v != "" {
+		token, tokenFile = v, ""
+	}
+	if v := query.Get("token_file"); v != "" {
+		token, tokenFile = "", v
+	}
+	if token == "" && tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read consul token file: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		cconfig.Token = token
 	}
-	status := &AdapterStatus{status: StatusDisconnected}
 
-	adapter := &ConsulAdapter{client: client, status: status, mtx: &sync.Mutex{}}
-	adapter.Ping()
+	tlsConfig := config.TLS
+	if v := query.Get("ca"); v != "" {
+		tlsConfig.CAFile = v
+	}
+	if v := query.Get("cert"); v != "" {
+		tlsConfig.CertFile = v
+	}
+	if v := query.Get("key"); v != "" {
+		tlsConfig.KeyFile = v
+	}
+	if v := query.Get("tls_skip_verify"); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls_skip_verify value %s", v)
+		}
+		tlsConfig.InsecureSkipVerify = skip
+	}
+
+	if uri.Scheme == CONSUL_TLS_SCHEME || tlsConfig.Enabled() {
+		cconfig.Scheme = "https"
+
+		tlsClientConfig, err := consul_api.SetupTLSConfig(&consul_api.TLSConfig{
+			Address:            cconfig.Address,
+			CAFile:             tlsConfig.CAFile,
+			CertFile:           tlsConfig.CertFile,
+			KeyFile:            tlsConfig.KeyFile,
+			InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid consul tls configuration: %v", err)
+		}
+
+		if tr, ok := client.Transport.(*httpcontrol.Transport); ok {
+			tr.TLSClientConfig = tlsClientConfig
+		}
+	}
 
-	return adapter
+	return cconfig, nil
 }
 
 func (c *ConsulAdapter) Leader() (*string, error) {
-	status := c.client.Status()
+	var leader string
 
-	leader, err := status.Leader()
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		leader, err = client.Status().Leader()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -49,34 +153,44 @@ func (c *ConsulAdapter) Leader() (*string, error) {
 
 func (c *ConsulAdapter) Register(sr ServiceRegistration) error {
 	if sr.TTL == "" {
-		sr.TTL = "5s"
+		sr.TTL = c.ttl.String()
 	}
-
-	service := &consul_api.AgentServiceRegistration{
-		Address: sr.AdvertiseAddr,
-		Port:    sr.Port,
-		ID:      sr.Id,
-		Name:    sr.Name,
-		Tags:    sr.Tags,
-		Check:   c.createTTLCheck(sr),
+	if sr.DeregisterCriticalAfter == "" && c.deregisterAfter > 0 {
+		sr.DeregisterCriticalAfter = c.deregisterAfter.String()
 	}
 
-	agent := c.client.Agent()
-
-	err := agent.ServiceRegister(service)
+	err := c.call(func(client *consul_api.Client) error {
+		return c.registerService(client, sr)
+	})
 	if err != nil {
 		return err
 	}
 
+	c.mtx.Lock()
+	c.registrations[sr.Id] = sr
+	reason, inMaintenance := c.maintenance[sr.Id]
+	c.mtx.Unlock()
+
 	platform.Logger.Debugf("registering service %s", sr.String())
 
+	if inMaintenance {
+		return c.call(func(client *consul_api.Client) error {
+			return client.Agent().EnableServiceMaintenance(sr.Id, reason)
+		})
+	}
+
 	return nil
 }
 
 func (c *ConsulAdapter) DeRegister(sr ServiceRegistration) error {
-	agent := c.client.Agent()
+	c.mtx.Lock()
+	delete(c.registrations, sr.Id)
+	delete(c.maintenance, sr.Id)
+	c.mtx.Unlock()
 
-	err := agent.ServiceDeregister(sr.Id)
+	err := c.call(func(client *consul_api.Client) error {
+		return client.Agent().ServiceDeregister(sr.Id)
+	})
 
 	if err != nil {
 		return err
@@ -87,32 +201,51 @@ func (c *ConsulAdapter) DeRegister(sr ServiceRegistration) error {
 }
 
 func (c *ConsulAdapter) Sync(sr ServiceRegistration) error {
-	key := c.createCheckKey(sr.Id)
-	agent := c.client.Agent()
+	return c.call(func(client *consul_api.Client) error {
+		return c.passTTL(client, sr)
+	})
+}
 
-	err := agent.PassTTL(key, "pass")
-	if err != nil {
-		return err
+func (c *ConsulAdapter) passTTL(client *consul_api.Client, sr ServiceRegistration) error {
+	agent := client.Agent()
+
+	for _, key := range c.ttlCheckKeys(sr) {
+		err := agent.PassTTL(key, "pass")
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
 func (c *ConsulAdapter) Ping() error {
-	status := c.client.Status()
-	leader, err := status.Leader()
+	var leader string
+	var peers []string
+
+	err := c.call(func(client *consul_api.Client) error {
+		status := client.Status()
+
+		var err error
+		leader, err = status.Leader()
+		if err != nil {
+			return err
+		}
+
+		peers, _ = status.Peers()
+		return nil
+	})
 
 	if err != nil {
-		c.setStatus(StatusDisconnected)
+		c.setStatus(StatusDisconnected, err)
 		return err
 	}
 
 	platform.Logger.Debugf("consul current leader %s", leader)
-
-	peers, _ := status.Peers()
 	platform.Logger.Debugf("consul current peers: %s", peers)
 
-	c.setStatus(StatusConnected)
+	c.setStatus(StatusConnected, nil)
+	c.cleanupStale()
 
 	return nil
 }
@@ -124,44 +257,57 @@ func (c *ConsulAdapter) Status() int {
 }
 
 func (c *ConsulAdapter) FindServices() (map[string][]string, error) {
-	catalog := c.client.Catalog()
-	qo := &consul_api.QueryOptions{AllowStale: false, RequireConsistent: true, WaitIndex: c.lastIndex}
+	qo := &consul_api.QueryOptions{AllowStale: false, RequireConsistent: true}
+
+	var services map[string][]string
+	var meta *consul_api.QueryMeta
 
-	services, meta, err := catalog.Services(qo)
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		services, meta, err = client.Catalog().Services(qo)
+		return err
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	c.lastIndex = meta.LastIndex
-
-	platform.Logger.Debugf("consul meta %s", meta)
+	platform.Logger.Debugf("consul meta %v", meta)
 
 	return services, nil
 }
 
-func (c *ConsulAdapter) FindService(name, tag string) ([]*consul_api.CatalogService, error) {
-	catalog := c.client.Catalog()
+func (c *ConsulAdapter) FindService(name, tag string) ([]*Instance, error) {
 	qo := &consul_api.QueryOptions{AllowStale: false, RequireConsistent: true}
-	//, WaitIndex: c.lastIndex}
 
-	cnodes, meta, err := catalog.Service(name, tag, qo)
+	var cnodes []*consul_api.CatalogService
+	var meta *consul_api.QueryMeta
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		cnodes, meta, err = client.Catalog().Service(name, tag, qo)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	if len(cnodes) == 0 {
-		return nil, fmt.Errorf("service %s not found", name)
+		platform.Logger.Debugf("service %s not found", name)
+		return nil, ErrServiceNotFound
 	}
 
-	c.lastIndex = meta.LastIndex
+	platform.Logger.Debugf("consul meta %v", meta)
 
-	platform.Logger.Debugf("consul meta %s", meta)
+	instances := make([]*Instance, 0, len(cnodes))
+	for _, cn := range cnodes {
+		instances = append(instances, toInstance(cn))
+	}
 
-	return cnodes, nil
+	return instances, nil
 }
 
-func (c *ConsulAdapter) CheckService(name, tag string, passing bool) ([]*consul_api.ServiceEntry, error) {
+func (c *ConsulAdapter) CheckService(name, tag string, passing bool) ([]*HealthEntry, error) {
 	_, err := c.FindService(name, "")
 
 	if err != nil {
@@ -169,19 +315,27 @@ func (c *ConsulAdapter) CheckService(name, tag string, passing bool) ([]*consul_
 	}
 
 	qo := &consul_api.QueryOptions{AllowStale: false, RequireConsistent: true}
-	//, WaitIndex: c.lastIndex}
 
-	health := c.client.Health()
+	var entries []*consul_api.ServiceEntry
+	var meta *consul_api.QueryMeta
 
-	entries, meta, err := health.Service(name, tag, passing, qo)
+	err = c.call(func(client *consul_api.Client) error {
+		var err error
+		entries, meta, err = client.Health().Service(name, tag, passing, qo)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	platform.Logger.Debugf("consul meta %s", meta)
-	c.lastIndex = meta.LastIndex
+	platform.Logger.Debugf("consul meta %v", meta)
 
-	return entries, nil
+	healthEntries := make([]*HealthEntry, 0, len(entries))
+	for _, e := range entries {
+		healthEntries = append(healthEntries, toHealthEntry(e))
+	}
+
+	return healthEntries, nil
 }
 
 func (c *ConsulAdapter) Disconnected() bool {
@@ -198,19 +352,183 @@ func (c *ConsulAdapter) Type() string {
 	return CONSUL_TYPE
 }
 
-func (c *ConsulAdapter) createTTLCheck(sr ServiceRegistration) *consul_api.AgentServiceCheck {
-	return &consul_api.AgentServiceCheck{TTL: sr.TTL}
+// agentServiceRegistration extends the consul client's registration with
+// check fields the vendored client does not know about yet.
+type agentServiceRegistration struct {
+	*consul_api.AgentServiceRegistration
+	Check  *agentServiceCheck   `json:",omitempty"`
+	Checks []*agentServiceCheck `json:",omitempty"`
+}
+
+type agentServiceCheck struct {
+	*consul_api.AgentServiceCheck
+	DeregisterCriticalServiceAfter string `json:",omitempty"`
+	TLSSkipVerify                  bool   `json:",omitempty"`
+}
+
+// registerService registers sr with the agent behind client.
+func (c *ConsulAdapter) registerService(client *consul_api.Client, sr ServiceRegistration) error {
+	_, err := client.Raw().Write("/v1/agent/service/register", c.agentRegistration(sr), nil, nil)
+	return err
+}
+
+func (c *ConsulAdapter) agentRegistration(sr ServiceRegistration) *agentServiceRegistration {
+	service := &agentServiceRegistration{
+		AgentServiceRegistration: &consul_api.AgentServiceRegistration{
+			Address: sr.AdvertiseAddr,
+			Port:    sr.Port,
+			ID:      sr.Id,
+			Name:    sr.Name,
+			Tags:    sr.Tags,
+		},
+	}
+
+	// consul only numbers check ids when more than one check is registered,
+	// see ttlCheckKeys
+	checks := c.createChecks(sr)
+	if len(checks) == 1 {
+		service.Check = checks[0]
+	} else {
+		service.Checks = checks
+	}
+
+	return service
+}
+
+// createTTLCheck returns the heartbeat check. It is the check that goes
+// critical when the process dies without deregistering, so it carries the
+// registration's DeregisterCriticalAfter.
+func (c *ConsulAdapter) createTTLCheck(sr ServiceRegistration) *agentServiceCheck {
+	return &agentServiceCheck{
+		AgentServiceCheck:              &consul_api.AgentServiceCheck{TTL: sr.TTL},
+		DeregisterCriticalServiceAfter: sr.DeregisterCriticalAfter,
+	}
+}
+
+// createChecks returns the TTL heartbeat check followed by every check
+// declared on the registration.
+func (c *ConsulAdapter) createChecks(sr ServiceRegistration) []*agentServiceCheck {
+	checks := []*agentServiceCheck{c.createTTLCheck(sr)}
+
+	for _, check := range sr.Checks {
+		acheck := &consul_api.AgentServiceCheck{
+			Interval: check.Interval,
+			Timeout:  check.Timeout,
+		}
+
+		switch check.Type {
+		case CheckTTL:
+			acheck.TTL = check.TTL
+		case CheckHTTP:
+			acheck.HTTP = sr.checkURL(check.Path)
+		case CheckTCP:
+			acheck.TCP = check.Address
+			if acheck.TCP == "" {
+				acheck.TCP = sr.checkHost()
+			}
+		}
+
+		checks = append(checks, &agentServiceCheck{AgentServiceCheck: acheck, TLSSkipVerify: check.TLSSkipVerify})
+	}
+
+	return checks
 }
 
 func (c *ConsulAdapter) createCheckKey(id string) string {
 	return "service:" + id
 }
 
-func (c *ConsulAdapter) setStatus(status int) {
+// ttlCheckKeys returns the ids consul assigned to the TTL checks created by
+// createChecks. A lone check is named after the service, otherwise checks are
+// suffixed with their 1-based position.
+func (c *ConsulAdapter) ttlCheckKeys(sr ServiceRegistration) []string {
+	key := c.createCheckKey(sr.Id)
+	if len(sr.Checks) == 0 {
+		return []string{key}
+	}
+
+	keys := []string{fmt.Sprintf("%s:%d", key, 1)}
+	for i, check := range sr.Checks {
+		if check.Type == CheckTTL {
+			keys = append(keys, fmt.Sprintf("%s:%d", key, i+2))
+		}
+	}
+	return keys
+}
+
+// SubscribeStatus calls fn whenever the adapter connects to or loses its
+// consul agents.
+func (c *ConsulAdapter) SubscribeStatus(fn StatusHandler) func() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	id := c.status.subscribe(fn)
+	return func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		delete(c.status.subscribers, id)
+	}
+}
+
+func (c *ConsulAdapter) LastStatusChange() StatusChange {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	if status != c.status.status {
-		platform.Logger.Debugf("setting status for adapter %s", c.status.String())
-		c.status.setStatus(status)
+	return c.status.last
+}
+
+func (c *ConsulAdapter) setStatus(status int, err error) {
+	c.mtx.Lock()
+	if status == c.status.status {
+		c.mtx.Unlock()
+		return
 	}
+	change := c.status.transition(status, err)
+	c.mtx.Unlock()
+
+	if err != nil {
+		platform.Logger.Warnf("registry adapter %s: %s", change, err)
+	} else {
+		platform.Logger.Infof("registry adapter %s", change)
+	}
+	c.status.notify()
+}
+
+func toInstance(cs *consul_api.CatalogService) *Instance {
+	return &Instance{
+		ID:          cs.ServiceID,
+		Name:        cs.ServiceName,
+		Node:        cs.Node,
+		NodeAddress: cs.Address,
+		Address:     cs.ServiceAddress,
+		Port:        cs.ServicePort,
+		Tags:        cs.ServiceTags,
+	}
+}
+
+func toHealthEntry(se *consul_api.ServiceEntry) *HealthEntry {
+	instance := &Instance{}
+	if se.Service != nil {
+		instance.ID = se.Service.ID
+		instance.Name = se.Service.Service
+		instance.Address = se.Service.Address
+		instance.Port = se.Service.Port
+		instance.Tags = se.Service.Tags
+	}
+	if se.Node != nil {
+		instance.Node = se.Node.Node
+		instance.NodeAddress = se.Node.Address
+	}
+
+	checks := make([]*HealthCheck, 0, len(se.Checks))
+	for _, hc := range se.Checks {
+		checks = append(checks, &HealthCheck{
+			ID:        hc.CheckID,
+			Name:      hc.Name,
+			Status:    hc.Status,
+			Output:    hc.Output,
+			ServiceID: hc.ServiceID,
+		})
+	}
+
+	return &HealthEntry{Instance: instance, Checks: checks}
 }
@@ -1,13 +1,21 @@
 package registry_test
 
 import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
-	consul_api "github.com/hashicorp/consul/api"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/testutil"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
 )
 
 var _ = Describe("Registry", func() {
@@ -27,6 +35,172 @@ var _ = Describe("Registry", func() {
 		Expect(r.Status()).To(Equal(registry.StatusDisconnected))
 	})
 
+	It("should fail over between every configured agent when none are reachable", func() {
+		config := registry.Config{AdapterURIs: []string{"consul://127.0.0.2:8500", "consul://127.0.0.3:8500"}}
+		r, err := registry.NewBackend(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.Status()).To(Equal(registry.StatusDisconnected))
+
+		nodes := r.(*registry.ConsulAdapter).Nodes()
+		Expect(nodes).To(HaveLen(2))
+		for _, n := range nodes {
+			Expect(n.Healthy).To(BeFalse())
+			Expect(n.Failures).To(Equal(1))
+		}
+	})
+
+	It("should reject adapter URIs with mixed schemes", func() {
+		config := registry.Config{AdapterURIs: []string{"consul://127.0.0.2:8500", "memory://"}}
+		_, err := registry.NewBackend(config)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should move registrations to the next agent when the active one fails", func() {
+		t, _ := GinkgoT().(*testing.T)
+		failover := testutil.NewConsulCluster(t)
+		defer failover.Leader.Stop()
+
+		agent := failover.Agents[0]
+		config := registry.Config{AdapterURIs: []string{"consul://" + agent.HTTPAddr, "consul://" + failover.Leader.HTTPAddr}}
+		fr, err := registry.NewBackend(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fr.Status()).To(Equal(registry.StatusConnected))
+
+		sr := registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "5s"}
+		Expect(fr.Register(sr)).To(Succeed())
+
+		agent.Stop()
+
+		Expect(fr.Sync(sr)).To(Succeed())
+
+		nodes := fr.(*registry.ConsulAdapter).Nodes()
+		Expect(nodes[0].Healthy).To(BeFalse())
+		Expect(nodes[1].Active).To(BeTrue())
+
+		Eventually(func() []string {
+			nodes := make([]string, 0)
+			instances, _ := fr.FindService("bifrost", "")
+			for _, i := range instances {
+				nodes = append(nodes, i.Node)
+			}
+			return nodes
+		}, TIMEOUT).Should(ContainElement(failover.Leader.Config.NodeName))
+	})
+
+	Context("acl tokens and tls", func() {
+		var server *ghttp.Server
+
+		leader := func() http.HandlerFunc {
+			return ghttp.RespondWithJSONEncoded(http.StatusOK, "127.0.0.1:8300")
+		}
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should send the ACL token with every request", func() {
+			server = ghttp.NewServer()
+			server.RouteToHandler("GET", "/v1/status/leader", ghttp.CombineHandlers(ghttp.VerifyRequest("GET", "/v1/status/leader", "token=secret"), leader()))
+			server.RouteToHandler("GET", "/v1/status/peers", ghttp.CombineHandlers(ghttp.VerifyRequest("GET", "/v1/status/peers", "token=secret"), ghttp.RespondWithJSONEncoded(http.StatusOK, []string{})))
+
+			r, err := registry.NewBackend(registry.Config{AdapterURI: "consul://" + server.Addr(), Token: "secret"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Status()).To(Equal(registry.StatusConnected))
+		})
+
+		It("should read the ACL token from the token_file parameter", func() {
+			server = ghttp.NewServer()
+			server.RouteToHandler("GET", "/v1/status/leader", ghttp.CombineHandlers(ghttp.VerifyRequest("GET", "/v1/status/leader", "token=from-file"), leader()))
+			server.RouteToHandler("GET", "/v1/status/peers", ghttp.RespondWithJSONEncoded(http.StatusOK, []string{}))
+
+			f, err := ioutil.TempFile("", "consul-token")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(f.Name())
+			f.WriteString("from-file\n")
+			f.Close()
+
+			r, err := registry.NewBackend(registry.Config{AdapterURI: "consul://" + server.Addr() + "?token_file=" + f.Name(), Token: "ignored"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Status()).To(Equal(registry.StatusConnected))
+		})
+
+		It("should talk https to a consuls agent signed by the configured CA", func() {
+			server = ghttp.NewTLSServer()
+			server.RouteToHandler("GET", "/v1/status/leader", leader())
+			server.RouteToHandler("GET", "/v1/status/peers", ghttp.RespondWithJSONEncoded(http.StatusOK, []string{}))
+
+			f, err := ioutil.TempFile("", "consul-ca")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(f.Name())
+			cert := server.HTTPTestServer.TLS.Certificates[0].Certificate[0]
+			pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
+			f.Close()
+
+			r, err := registry.NewBackend(registry.Config{AdapterURI: "consuls://" + server.Addr() + "?ca=" + f.Name()})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Status()).To(Equal(registry.StatusConnected))
+
+			r, err = registry.NewBackend(registry.Config{AdapterURI: "consuls://" + server.Addr()})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Status()).To(Equal(registry.StatusDisconnected))
+		})
+
+		It("should fail to create an adapter with an unreadable token file or CA bundle", func() {
+			server = ghttp.NewServer()
+
+			_, err := registry.NewBackend(registry.Config{AdapterURI: "consul://" + server.Addr(), TokenFile: "/does/not/exist"})
+			Expect(err).To(HaveOccurred())
+
+			_, err = registry.NewBackend(registry.Config{AdapterURI: "consuls://" + server.Addr() + "?ca=/does/not/exist"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("should not block catalog queries on the index of an earlier query", func() {
+		var indexed int32
+		catalog := func(body interface{}) http.HandlerFunc {
+			return func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("index") != "" {
+					atomic.AddInt32(&indexed, 1)
+				}
+				w.Header().Set("X-Consul-Index", "42")
+				ghttp.RespondWithJSONEncoded(http.StatusOK, body)(w, req)
+			}
+		}
+		node := []map[string]interface{}{{"Node": "node1", "Address": "127.0.0.1", "ServiceID": "router1", "ServiceName": "bifrost", "ServicePort": 3001}}
+
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.RouteToHandler("GET", "/v1/status/leader", ghttp.RespondWithJSONEncoded(http.StatusOK, "127.0.0.1:8300"))
+		server.RouteToHandler("GET", "/v1/status/peers", ghttp.RespondWithJSONEncoded(http.StatusOK, []string{}))
+		server.RouteToHandler("GET", "/v1/catalog/services", catalog(map[string][]string{"bifrost": {}}))
+		server.RouteToHandler("GET", "/v1/catalog/service/bifrost", catalog(node))
+		server.RouteToHandler("GET", "/v1/health/service/bifrost", catalog([]interface{}{}))
+
+		adapter, err := registry.NewBackend(registry.Config{AdapterURI: "consul://" + server.Addr()})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = adapter.FindServices()
+		Expect(err).ToNot(HaveOccurred())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				_, err := adapter.FindServices()
+				Expect(err).ToNot(HaveOccurred())
+				_, err = adapter.FindService("bifrost", "")
+				Expect(err).ToNot(HaveOccurred())
+				_, err = adapter.CheckService("bifrost", "", true)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+		}
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&indexed)).To(BeZero())
+	})
+
 	Context("consul registry", func() {
 		It("should register/deregister a service", func() {
 			sr := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", Tags: []string{"v1"}}
@@ -39,13 +213,13 @@ var _ = Describe("Registry", func() {
 				return sr
 			}, TIMEOUT).Should(HaveLen(2))
 
-			Eventually(func() []*consul_api.CatalogService {
+			Eventually(func() []*registry.Instance {
 				sr, err := r.FindService("bifrost", "")
 				Expect(err).ToNot(HaveOccurred())
 				return sr
 			}, TIMEOUT).ShouldNot(BeNil())
 
-			var out []*consul_api.ServiceEntry
+			var out []*registry.HealthEntry
 
 			Eventually(func() int {
 				entries, err := r.CheckService("bifrost", "", false)
@@ -54,6 +228,9 @@ var _ = Describe("Registry", func() {
 				return len(entries)
 			}, TIMEOUT).ShouldNot(Equal(0))
 
+			Expect(out[0].Instance.ID).To(Equal(sr.Id))
+			Expect(out[0].Instance.Port).To(Equal(sr.Port))
+
 			Eventually(func() int {
 				r.Sync(sr)
 				entries, err := r.CheckService("bifrost", "", true)
@@ -83,7 +260,7 @@ var _ = Describe("Registry", func() {
 			err := r.Register(sr1)
 			Expect(err).ToNot(HaveOccurred())
 
-			Eventually(func() []*consul_api.CatalogService {
+			Eventually(func() []*registry.Instance {
 				sr, err := r.FindService("bifrost", "")
 				Expect(err).ToNot(HaveOccurred())
 				return sr
@@ -106,5 +283,33 @@ var _ = Describe("Registry", func() {
 
 		})
 
+		It("should register the declared checks alongside the TTL check", func() {
+			sr := registry.ServiceRegistration{
+				AdvertiseAddr: "127.0.0.1",
+				Port:          3002,
+				Id:            "router2",
+				Name:          "heimdal",
+				TTL:           "5s",
+				Checks: []registry.Check{
+					registry.HTTPCheck("/health", "10s", "1s"),
+					registry.TTLCheck("5s"),
+				},
+			}
+			err := r.Register(sr)
+			Expect(err).ToNot(HaveOccurred())
+			defer r.DeRegister(sr)
+
+			Eventually(func() int {
+				entries, err := r.CheckService("heimdal", "", false)
+				Expect(err).ToNot(HaveOccurred())
+				if len(entries) == 0 {
+					return 0
+				}
+				return len(entries[0].Checks)
+			}, TIMEOUT).Should(BeNumerically(">=", 3))
+
+			Expect(r.Sync(sr)).To(Succeed())
+		})
+
 	})
 })
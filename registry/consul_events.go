@@ -0,0 +1,42 @@
+package registry
+
+import (
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+func (c *ConsulAdapter) FireEvent(name string, payload []byte) (string, error) {
+	var id string
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		id, _, err = client.Event().Fire(&consul_api.UserEvent{Name: name, Payload: payload}, nil)
+		return err
+	})
+	return id, err
+}
+
+func (c *ConsulAdapter) WatchEvents(name string, index uint64, wait time.Duration) ([]*Event, uint64, error) {
+	if wait > maxBlockingWait {
+		wait = maxBlockingWait
+	}
+
+	var events []*consul_api.UserEvent
+	var meta *consul_api.QueryMeta
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		events, meta, err = client.Event().List(name, &consul_api.QueryOptions{WaitIndex: index, WaitTime: wait})
+		return err
+	})
+	if err != nil {
+		return nil, index, err
+	}
+
+	out := make([]*Event, 0, len(events))
+	for _, e := range events {
+		out = append(out, &Event{ID: e.ID, Name: e.Name, Payload: e.Payload, LTime: e.LTime})
+	}
+	return out, meta.LastIndex, nil
+}
@@ -0,0 +1,59 @@
+package registry
+
+import (
+	consul_api "github.com/hashicorp/consul/api"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+// RegisterExternal registers the service in the catalog on its synthetic
+// node. Agents only sync the nodes they run on, so catalog registrations on
+// a node without an agent stay until DeregisterExternal removes them.
+func (c *ConsulAdapter) RegisterExternal(e ExternalRegistration) error {
+	if !e.Valid() {
+		return ErrInvalidServiceRegistration
+	}
+	e = e.withDefaults()
+
+	err := c.call(func(client *consul_api.Client) error {
+		_, err := client.Catalog().Register(&consul_api.CatalogRegistration{
+			Node:    e.Node,
+			Address: e.NodeAddress,
+			Service: &consul_api.AgentService{
+				ID:      e.Id,
+				Service: e.Name,
+				Tags:    e.Tags,
+				Port:    e.Port,
+				Address: e.Address,
+			},
+		}, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	platform.Logger.Debugf("registered external service %s on node %s", e.Id, e.Node)
+	return nil
+}
+
+func (c *ConsulAdapter) DeregisterExternal(e ExternalRegistration) error {
+	if !e.identified() {
+		return ErrInvalidServiceRegistration
+	}
+	e = e.withDefaults()
+
+	err := c.call(func(client *consul_api.Client) error {
+		_, err := client.Catalog().Deregister(&consul_api.CatalogDeregistration{
+			Node:      e.Node,
+			ServiceID: e.Id,
+		}, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	platform.Logger.Debugf("deregistered external service %s from node %s", e.Id, e.Node)
+	return nil
+}
@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/heimdal"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+// Blocking queries share the adapter's http client, so they have to return
+// before its request timeout fires.
+var maxBlockingWait = heimdal.DEFAULT_TIMEOUT - 1*time.Second
+
+func (c *ConsulAdapter) Get(key string) (*KVPair, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	var pair *consul_api.KVPair
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		pair, _, err = client.KV().Get(key, &consul_api.QueryOptions{RequireConsistent: true})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if pair == nil {
+		return nil, ErrKeyNotFound
+	}
+	return toKVPair(pair), nil
+}
+
+func (c *ConsulAdapter) Put(key string, value []byte) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	return c.call(func(client *consul_api.Client) error {
+		_, err := client.KV().Put(&consul_api.KVPair{Key: key, Value: value}, nil)
+		return err
+	})
+}
+
+func (c *ConsulAdapter) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	return c.call(func(client *consul_api.Client) error {
+		_, err := client.KV().Delete(key, nil)
+		return err
+	})
+}
+
+func (c *ConsulAdapter) DeletePrefix(prefix string) error {
+	if !validKey(prefix) {
+		return ErrInvalidKey
+	}
+
+	return c.call(func(client *consul_api.Client) error {
+		_, err := client.KV().DeleteTree(prefix, nil)
+		return err
+	})
+}
+
+func (c *ConsulAdapter) List(prefix string) ([]*KVPair, error) {
+	var pairs consul_api.KVPairs
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		pairs, _, err = client.KV().List(prefix, &consul_api.QueryOptions{RequireConsistent: true})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*KVPair, 0, len(pairs))
+	for _, p := range pairs {
+		out = append(out, toKVPair(p))
+	}
+	return out, nil
+}
+
+func (c *ConsulAdapter) WatchList(prefix string, index uint64, wait time.Duration) ([]*KVPair, uint64, error) {
+	if wait > maxBlockingWait {
+		wait = maxBlockingWait
+	}
+
+	var pairs consul_api.KVPairs
+	var meta *consul_api.QueryMeta
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		pairs, meta, err = client.KV().List(prefix, &consul_api.QueryOptions{WaitIndex: index, WaitTime: wait})
+		return err
+	})
+	if err != nil {
+		return nil, index, err
+	}
+
+	out := make([]*KVPair, 0, len(pairs))
+	for _, p := range pairs {
+		out = append(out, toKVPair(p))
+	}
+	return out, meta.LastIndex, nil
+}
+
+func (c *ConsulAdapter) CAS(pair *KVPair) (bool, error) {
+	if !validKey(pair.Key) {
+		return false, ErrInvalidKey
+	}
+
+	var ok bool
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		ok, _, err = client.KV().CAS(&consul_api.KVPair{
+			Key:         pair.Key,
+			Value:       pair.Value,
+			Flags:       pair.Flags,
+			ModifyIndex: pair.ModifyIndex,
+		}, nil)
+		return err
+	})
+	return ok, err
+}
+
+func toKVPair(p *consul_api.KVPair) *KVPair {
+	return &KVPair{
+		Key:         p.Key,
+		Value:       p.Value,
+		Flags:       p.Flags,
+		ModifyIndex: p.ModifyIndex,
+		Session:     p.Session,
+	}
+}
@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+// Sessions are not bound to the agent's node health unless asked to, so a
+// lock survives a failover to another agent as long as it is renewed.
+func (c *ConsulAdapter) CreateSession(name string, ttl time.Duration, checks []string) (string, error) {
+	var id string
+
+	entry := &consul_api.SessionEntry{
+		Name:     name,
+		TTL:      ttl.String(),
+		Behavior: consul_api.SessionBehaviorRelease,
+		Checks:   checks,
+	}
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		if len(checks) == 0 {
+			id, _, err = client.Session().CreateNoChecks(entry, nil)
+		} else {
+			id, _, err = client.Session().Create(entry, nil)
+		}
+		return err
+	})
+	return id, err
+}
+
+func (c *ConsulAdapter) RenewSession(id string) error {
+	var entry *consul_api.SessionEntry
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		entry, _, err = client.Session().Renew(id, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		return ErrSessionExpired
+	}
+	return nil
+}
+
+func (c *ConsulAdapter) DestroySession(id string) error {
+	return c.call(func(client *consul_api.Client) error {
+		_, err := client.Session().Destroy(id, nil)
+		return err
+	})
+}
+
+func (c *ConsulAdapter) AcquireKey(key string, value []byte, session string) (bool, error) {
+	if !validKey(key) {
+		return false, ErrInvalidKey
+	}
+
+	var ok bool
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		ok, _, err = client.KV().Acquire(&consul_api.KVPair{
+			Key:     key,
+			Value:   value,
+			Session: session,
+			Flags:   consul_api.LockFlagValue,
+		}, nil)
+		return err
+	})
+	return ok, err
+}
+
+func (c *ConsulAdapter) ReleaseKey(key string, session string) (bool, error) {
+	if !validKey(key) {
+		return false, ErrInvalidKey
+	}
+
+	var ok bool
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		ok, _, err = client.KV().Release(&consul_api.KVPair{
+			Key:     key,
+			Session: session,
+			Flags:   consul_api.LockFlagValue,
+		}, nil)
+		return err
+	})
+	return ok, err
+}
+
+func (c *ConsulAdapter) WatchLock(key string, index uint64, wait time.Duration) (string, uint64, error) {
+	if wait > maxBlockingWait {
+		wait = maxBlockingWait
+	}
+
+	var pair *consul_api.KVPair
+	var meta *consul_api.QueryMeta
+
+	err := c.call(func(client *consul_api.Client) error {
+		var err error
+		pair, meta, err = client.KV().Get(key, &consul_api.QueryOptions{
+			WaitIndex:         index,
+			WaitTime:          wait,
+			RequireConsistent: true,
+		})
+		return err
+	})
+	if err != nil {
+		return "", index, err
+	}
+
+	if pair == nil {
+		return "", meta.LastIndex, nil
+	}
+	return pair.Session, meta.LastIndex, nil
+}
@@ -0,0 +1,33 @@
+package registry
+
+import (
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+func (c *ConsulAdapter) EnableMaintenance(sr ServiceRegistration, reason string) error {
+	err := c.call(func(client *consul_api.Client) error {
+		return client.Agent().EnableServiceMaintenance(sr.Id, reason)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.maintenance[sr.Id] = reason
+	return nil
+}
+
+func (c *ConsulAdapter) DisableMaintenance(sr ServiceRegistration) error {
+	err := c.call(func(client *consul_api.Client) error {
+		return client.Agent().DisableServiceMaintenance(sr.Id)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.maintenance, sr.Id)
+	return nil
+}
@@ -0,0 +1,249 @@
+package registry
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+const (
+	// How long a failed agent is skipped before it is tried again
+	defaultNodeRetryInterval = 30 * time.Second
+)
+
+var ErrNoRegistryNodes = errors.New("no registry nodes configured")
+
+// NodeStatus describes the health of a single agent known to the adapter.
+type NodeStatus struct {
+	Address     string
+	Active      bool
+	Healthy     bool
+	Failures    int
+	LastError   string
+	LastFailure time.Time
+}
+
+type consulNode struct {
+	address     string
+	client      *consul_api.Client
+	healthy     bool
+	failures    int
+	lastError   string
+	lastFailure time.Time
+	// ids of services registered on this agent before we failed over away
+	// from it, deregistered once the agent is reachable again
+	stale map[string]struct{}
+}
+
+func newConsulNode(address string, client *consul_api.Client) *consulNode {
+	return &consulNode{
+		address: address,
+		client:  client,
+		healthy: true,
+		stale:   make(map[string]struct{}),
+	}
+}
+
+// available reports whether the node may be selected. Callers must hold the
+// adapter lock.
+func (n *consulNode) available(now time.Time) bool {
+	return n.healthy || now.Sub(n.lastFailure) > defaultNodeRetryInterval
+}
+
+// Nodes returns the health of every agent the adapter can fail over to.
+func (c *ConsulAdapter) Nodes() []NodeStatus {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	nodes := make([]NodeStatus, 0, len(c.nodes))
+	for i, n := range c.nodes {
+		nodes = append(nodes, NodeStatus{
+			Address:     n.address,
+			Active:      i == c.current,
+			Healthy:     n.healthy,
+			Failures:    n.failures,
+			LastError:   n.lastError,
+			LastFailure: n.lastFailure,
+		})
+	}
+	return nodes
+}
+
+// call runs fn against the active agent. When the agent cannot be reached it
+// is marked unhealthy and fn is retried on the next available agent, so each
+// agent is tried at most once per call.
+func (c *ConsulAdapter) call(fn func(*consul_api.Client) error) error {
+	c.mtx.Lock()
+	attempts := len(c.nodes)
+	c.mtx.Unlock()
+
+	if attempts == 0 {
+		return ErrNoRegistryNodes
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		node := c.activeNode()
+
+		err = fn(node.client)
+		if !isConnectionError(err) {
+			c.markHealthy(node)
+			return err
+		}
+
+		c.markFailed(node, err)
+		if !c.failover(node) {
+			break
+		}
+	}
+	c.setStatus(StatusDisconnected, err)
+	return err
+}
+
+func (c *ConsulAdapter) activeNode() *consulNode {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.nodes[c.current]
+}
+
+func (c *ConsulAdapter) markHealthy(n *consulNode) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !n.healthy {
+		platform.Logger.Infof("consul agent %s is reachable again", n.address)
+	}
+	n.healthy = true
+}
+
+func (c *ConsulAdapter) markFailed(n *consulNode, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	n.healthy = false
+	n.failures++
+	n.lastError = err.Error()
+	n.lastFailure = time.Now()
+}
+
+// failover moves the adapter off of the failed node and onto the next
+// available agent, preferring agents that have not failed recently. Agent
+// registrations are local to the agent they were made on, so every service
+// registered through the adapter is registered again on the new agent.
+func (c *ConsulAdapter) failover(from *consulNode) bool {
+	c.mtx.Lock()
+
+	if c.nodes[c.current] != from {
+		// another call already moved us
+		c.mtx.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	next := -1
+	for i := 1; i < len(c.nodes); i++ {
+		idx := (c.current + i) % len(c.nodes)
+		n := c.nodes[idx]
+		if n.available(now) {
+			next = idx
+			break
+		}
+		if next == -1 || n.lastFailure.Before(c.nodes[next].lastFailure) {
+			next = idx
+		}
+	}
+
+	if next == -1 {
+		c.mtx.Unlock()
+		return false
+	}
+
+	c.current = next
+	to := c.nodes[next]
+
+	registrations := make([]ServiceRegistration, 0, len(c.registrations))
+	for id, sr := range c.registrations {
+		from.stale[id] = struct{}{}
+		delete(to.stale, id)
+		registrations = append(registrations, sr)
+	}
+	maintenance := make(map[string]string, len(c.maintenance))
+	for id, reason := range c.maintenance {
+		maintenance[id] = reason
+	}
+	c.mtx.Unlock()
+
+	platform.Logger.Infof("consul agent %s failed, switching to %s", from.address, to.address)
+
+	for _, sr := range registrations {
+		err := c.registerService(to.client, sr)
+		if err == nil {
+			err = c.passTTL(to.client, sr)
+		}
+		if reason, ok := maintenance[sr.Id]; ok && err == nil {
+			err = to.client.Agent().EnableServiceMaintenance(sr.Id, reason)
+		}
+		if err != nil {
+			platform.Logger.Infof("unable to move service %s to consul agent %s: %s", sr.Id, to.address, err)
+			continue
+		}
+		platform.Logger.Infof("moved service %s to consul agent %s", sr.Id, to.address)
+	}
+
+	return true
+}
+
+// cleanupStale removes registrations left behind on agents we failed over
+// away from, once those agents are reachable again.
+func (c *ConsulAdapter) cleanupStale() {
+	c.mtx.Lock()
+	type staleNode struct {
+		node *consulNode
+		ids  []string
+	}
+	pending := make([]staleNode, 0)
+	for i, n := range c.nodes {
+		if i == c.current || len(n.stale) == 0 {
+			continue
+		}
+		ids := make([]string, 0, len(n.stale))
+		for id := range n.stale {
+			ids = append(ids, id)
+		}
+		pending = append(pending, staleNode{node: n, ids: ids})
+	}
+	c.mtx.Unlock()
+
+	for _, p := range pending {
+		for _, id := range p.ids {
+			err := p.node.client.Agent().ServiceDeregister(id)
+			if isConnectionError(err) {
+				platform.Logger.Debugf("consul agent %s is still unreachable: %s", p.node.address, err)
+				break
+			}
+
+			if err != nil {
+				platform.Logger.Infof("unable to remove stale service %s from consul agent %s: %s", id, p.node.address, err)
+			} else {
+				platform.Logger.Infof("removed stale service %s from consul agent %s", id, p.node.address)
+			}
+
+			c.mtx.Lock()
+			delete(p.node.stale, id)
+			p.node.healthy = true
+			c.mtx.Unlock()
+		}
+	}
+}
+
+// isConnectionError reports whether err means the agent could not be reached,
+// as opposed to the agent rejecting the request.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
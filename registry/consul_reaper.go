@@ -0,0 +1,30 @@
+package registry
+
+import (
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+// DeregisterInstance removes an instance from consul. Instances on the
+// active agent's node are deregistered through the agent. Others are removed
+// from the catalog, which only sticks when their own agent is gone too: a
+// live agent syncs its services back, and should rely on
+// DeregisterCriticalAfter instead.
+func (c *ConsulAdapter) DeregisterInstance(instance *Instance) error {
+	return c.call(func(client *consul_api.Client) error {
+		agent := client.Agent()
+		node, err := agent.NodeName()
+		if err != nil {
+			return err
+		}
+
+		if instance.Node == node {
+			return agent.ServiceDeregister(instance.ID)
+		}
+
+		_, err = client.Catalog().Deregister(&consul_api.CatalogDeregistration{
+			Node:      instance.Node,
+			ServiceID: instance.ID,
+		}, nil)
+		return err
+	})
+}
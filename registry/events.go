@@ -0,0 +1,246 @@
+package registry
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+const (
+	// How long a single blocking query for events waits. Backends may clamp
+	// this to stay under their request timeout.
+	defaultEventWaitTime = 10 * time.Second
+
+	// Upper bound for the delay between failed event polls
+	defaultEventMaxBackoff = 30 * time.Second
+
+	// Delay before polling again when the registry returned an index it
+	// cannot block on
+	defaultEventIdleWait = time.Second
+)
+
+var ErrEventsNotSupported = errors.New("registry adapter does not support events")
+
+// Event is a user event broadcast to every instance through the registry.
+type Event struct {
+	ID      string
+	Name    string
+	Payload []byte
+	// LTime is the registry's logical clock at the time the event was fired.
+	LTime uint64
+}
+
+// Events is implemented by adapters that can broadcast user events. The
+// registry only keeps a bounded buffer of the most recent events.
+type Events interface {
+	FireEvent(name string, payload []byte) (string, error)
+	// WatchEvents blocks until an event is fired past index or wait elapses
+	// and returns the buffered events, oldest first, along with the index to
+	// pass to the next call. The index is opaque and not monotonic. A blank
+	// name lists every event.
+	WatchEvents(name string, index uint64, wait time.Duration) ([]*Event, uint64, error)
+}
+
+// EventHandler is called for every event matching its subscription.
+type EventHandler func(e *Event)
+
+// EventBus publishes named events to every instance and dispatches the
+// events it receives to subscribed handlers. Events are delivered at most
+// once per bus, including to the instance that published them, and only
+// events fired after Start are delivered.
+type EventBus struct {
+	events   Events
+	handlers map[string][]EventHandler
+	seen     map[string]struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	mtx      *sync.Mutex
+}
+
+// NewEventBus returns a bus on the registry's events, or
+// ErrEventsNotSupported when the adapter cannot broadcast events.
+func NewEventBus(adapter RegistryAdapter) (*EventBus, error) {
+	events, ok := adapter.(Events)
+	if !ok {
+		return nil, ErrEventsNotSupported
+	}
+
+	return &EventBus{
+		events:   events,
+		handlers: make(map[string][]EventHandler),
+		mtx:      &sync.Mutex{},
+	}, nil
+}
+
+// Publish fires an event and returns its id.
+func (b *EventBus) Publish(name string, payload []byte) (string, error) {
+	return b.events.FireEvent(name, payload)
+}
+
+// Subscribe calls h for every event named name. A name ending in "*"
+// subscribes to every event with that prefix, so "invalidate-cache:*"
+// matches "invalidate-cache:account-42".
+func (b *EventBus) Subscribe(name string, h EventHandler) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.handlers[name] = append(b.handlers[name], h)
+}
+
+// Start marks the events the registry already holds as seen and polls for
+// new ones until Stop is called.
+func (b *EventBus) Start() error {
+	b.mtx.Lock()
+	if b.quit != nil {
+		b.mtx.Unlock()
+		return nil
+	}
+	b.mtx.Unlock()
+
+	events, index, err := b.events.WatchEvents("", 0, defaultEventWaitTime)
+	if err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.seen = make(map[string]struct{})
+	for _, e := range events {
+		b.seen[e.ID] = struct{}{}
+	}
+
+	b.quit = make(chan struct{})
+	b.done = make(chan struct{})
+	go b.poll(index, b.quit, b.done)
+
+	return nil
+}
+
+// Stop ends polling and waits for handlers that are running to return.
+func (b *EventBus) Stop() {
+	b.mtx.Lock()
+	quit, done := b.quit, b.done
+	b.quit, b.done = nil, nil
+	b.mtx.Unlock()
+
+	if quit == nil {
+		return
+	}
+	close(quit)
+	<-done
+}
+
+func (b *EventBus) poll(index uint64, quit, done chan struct{}) {
+	defer close(done)
+
+	type result struct {
+		events []*Event
+		index  uint64
+		err    error
+	}
+
+	var backoff time.Duration
+	for {
+		// run the blocking query aside so that Stop returns right away
+		watch := make(chan result, 1)
+		go func(index uint64) {
+			events, next, err := b.events.WatchEvents("", index, defaultEventWaitTime)
+			watch <- result{events, next, err}
+		}(index)
+
+		var r result
+		select {
+		case r = <-watch:
+		case <-quit:
+			return
+		}
+
+		if r.err != nil {
+			if backoff == 0 {
+				backoff = time.Second
+			} else {
+				backoff *= 2
+			}
+			if backoff > defaultEventMaxBackoff {
+				backoff = defaultEventMaxBackoff
+			}
+			platform.Logger.Infof("unable to poll events, retrying in %v: %s", backoff, r.err)
+
+			select {
+			case <-time.After(backoff):
+			case <-quit:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if r.index == 0 {
+			// polling again with a zero index would return right away
+			select {
+			case <-time.After(defaultEventIdleWait):
+			case <-quit:
+				return
+			}
+		}
+
+		if r.index == index {
+			continue
+		}
+		index = r.index
+
+		b.dispatch(r.events)
+	}
+}
+
+// dispatch delivers the events that have not been seen yet. Only ids still
+// in the registry's buffer are remembered, since older events cannot be
+// listed again.
+func (b *EventBus) dispatch(events []*Event) {
+	b.mtx.Lock()
+	seen := make(map[string]struct{}, len(events))
+	fresh := make([]*Event, 0)
+	for _, e := range events {
+		if _, ok := b.seen[e.ID]; !ok {
+			fresh = append(fresh, e)
+		}
+		seen[e.ID] = struct{}{}
+	}
+	b.seen = seen
+	b.mtx.Unlock()
+
+	for _, e := range fresh {
+		for _, h := range b.handlersFor(e.Name) {
+			b.handle(h, e)
+		}
+	}
+}
+
+func (b *EventBus) handlersFor(name string) []EventHandler {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	handlers := make([]EventHandler, 0)
+	for pattern, hs := range b.handlers {
+		if pattern == name || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))) {
+			handlers = append(handlers, hs...)
+		}
+	}
+	return handlers
+}
+
+// handle calls h, keeping a panicking handler from stopping the bus.
+func (b *EventBus) handle(h EventHandler, e *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			platform.Logger.Errorf("handler for event %s panicked: %v\n%s", e.Name, r, buf)
+		}
+	}()
+	h(e)
+}
@@ -0,0 +1,105 @@
+package registry_test
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func behavesLikeEventBus(newAdapter func() registry.RegistryAdapter) {
+	var adapter registry.RegistryAdapter
+	var bus *registry.EventBus
+
+	BeforeEach(func() {
+		adapter = newAdapter()
+
+		var err error
+		bus, err = registry.NewEventBus(adapter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		bus.Stop()
+	})
+
+	It("should deliver new events to matching subscribers once", func() {
+		_, err := bus.Publish("platform-test-before-start", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		received := make(chan *registry.Event, 10)
+		bus.Subscribe("platform-test-invalidate:*", func(e *registry.Event) {
+			received <- e
+		})
+		bus.Subscribe("platform-test-before-start", func(e *registry.Event) {
+			received <- e
+		})
+		bus.Subscribe("platform-test-panics", func(e *registry.Event) {
+			panic("boom")
+		})
+
+		Expect(bus.Start()).To(Succeed())
+
+		other, err := registry.NewEventBus(adapter)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = other.Publish("platform-test-panics", nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := other.Publish("platform-test-invalidate:account-42", []byte("42"))
+		Expect(err).ToNot(HaveOccurred())
+
+		var e *registry.Event
+		Eventually(received, 10).Should(Receive(&e))
+		Expect(e.ID).To(Equal(id))
+		Expect(e.Name).To(Equal("platform-test-invalidate:account-42"))
+		Expect(string(e.Payload)).To(Equal("42"))
+
+		_, err = other.Publish("platform-test-unrelated", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(received, 1).ShouldNot(Receive())
+	})
+}
+
+type countingEvents struct {
+	*registry.MemoryAdapter
+	calls int32
+}
+
+func (c *countingEvents) WatchEvents(name string, index uint64, wait time.Duration) ([]*registry.Event, uint64, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.MemoryAdapter.WatchEvents(name, index, wait)
+}
+
+var _ = Describe("EventBus", func() {
+	It("should not be supported by adapters without events", func() {
+		_, err := registry.NewEventBus(new(fakes.FakeRegistryAdapter))
+		Expect(err).To(Equal(registry.ErrEventsNotSupported))
+	})
+
+	Context("memory adapter", func() {
+		behavesLikeEventBus(func() registry.RegistryAdapter {
+			return registry.NewMemoryAdapter()
+		})
+
+		It("should block while no events are fired", func() {
+			adapter := &countingEvents{MemoryAdapter: registry.NewMemoryAdapter()}
+			bus, err := registry.NewEventBus(adapter)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bus.Start()).To(Succeed())
+			defer bus.Stop()
+
+			calls := func() int32 { return atomic.LoadInt32(&adapter.calls) }
+			Consistently(calls, 200*time.Millisecond).Should(BeNumerically("<=", 2))
+		})
+	})
+
+	Context("consul adapter", func() {
+		behavesLikeEventBus(func() registry.RegistryAdapter {
+			return r
+		})
+	})
+})
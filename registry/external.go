@@ -0,0 +1,42 @@
+package registry
+
+// Node external services are registered on when they do not name one
+const DefaultExternalNode = "external"
+
+// ExternalRegistration describes a dependency we do not run ourselves, such
+// as a managed database or a partner API. Registering it puts it into
+// discovery next to our own services, so publishers and heimdal clients can
+// find it the same way. No agent heartbeats it, so it is always reported as
+// passing until it is deregistered.
+type ExternalRegistration struct {
+	// Node is the synthetic node the service is registered on, and
+	// NodeAddress its address. They default to DefaultExternalNode and to
+	// Address.
+	Node        string
+	NodeAddress string
+	Id          string
+	Name        string
+	Address     string
+	Port        int
+	Tags        []string
+}
+
+func (e *ExternalRegistration) Valid() bool {
+	return e.Id != "" && e.Name != "" && e.Address != "" && e.Port != 0
+}
+
+// identified reports whether e names the service to deregister. A blank id
+// would deregister every service on the node.
+func (e *ExternalRegistration) identified() bool {
+	return e.Id != "" && e.Name != ""
+}
+
+func (e ExternalRegistration) withDefaults() ExternalRegistration {
+	if e.Node == "" {
+		e.Node = DefaultExternalNode
+	}
+	if e.NodeAddress == "" {
+		e.NodeAddress = e.Address
+	}
+	return e
+}
@@ -0,0 +1,72 @@
+package registry_test
+
+import (
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func behavesLikeExternalRegistry(newAdapter func() registry.RegistryAdapter) {
+	var adapter registry.RegistryAdapter
+	var ext registry.ExternalRegistration
+
+	BeforeEach(func() {
+		adapter = newAdapter()
+		ext = registry.ExternalRegistration{Id: "billing-db1", Name: "billing-db", Address: "10.20.0.5", Port: 5432, Tags: []string{"primary"}}
+	})
+
+	It("should make external services discoverable as passing instances", func() {
+		Expect(adapter.RegisterExternal(ext)).To(Succeed())
+		defer adapter.DeregisterExternal(ext)
+
+		var entries []*registry.HealthEntry
+		Eventually(func() int {
+			var err error
+			entries, err = adapter.CheckService("billing-db", "primary", true)
+			Expect(err).ToNot(HaveOccurred())
+			return len(entries)
+		}, TIMEOUT).Should(Equal(1))
+
+		instance := entries[0].Instance
+		Expect(instance.ID).To(Equal(ext.Id))
+		Expect(instance.Node).To(Equal(registry.DefaultExternalNode))
+		Expect(instance.HostPort()).To(Equal("10.20.0.5:5432"))
+
+		Expect(adapter.DeregisterExternal(ext)).To(Succeed())
+		Eventually(func() error {
+			_, err := adapter.FindService("billing-db", "")
+			return err
+		}, TIMEOUT).Should(HaveOccurred())
+	})
+
+	It("should reject incomplete registrations", func() {
+		Expect(adapter.RegisterExternal(registry.ExternalRegistration{Name: "billing-db"})).To(Equal(registry.ErrInvalidServiceRegistration))
+	})
+
+	It("should refuse to deregister without an id", func() {
+		Expect(adapter.RegisterExternal(ext)).To(Succeed())
+		defer adapter.DeregisterExternal(ext)
+
+		Expect(adapter.DeregisterExternal(registry.ExternalRegistration{Name: "billing-db"})).To(Equal(registry.ErrInvalidServiceRegistration))
+		Expect(adapter.DeregisterExternal(registry.ExternalRegistration{Id: "billing-db1"})).To(Equal(registry.ErrInvalidServiceRegistration))
+
+		instances, err := adapter.FindService("billing-db", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instances).To(HaveLen(1))
+	})
+}
+
+var _ = Describe("External services", func() {
+	Context("memory adapter", func() {
+		behavesLikeExternalRegistry(func() registry.RegistryAdapter {
+			return registry.NewMemoryAdapter()
+		})
+	})
+
+	Context("consul adapter", func() {
+		behavesLikeExternalRegistry(func() registry.RegistryAdapter {
+			return r
+		})
+	})
+})
@@ -4,7 +4,6 @@ package fakes
 import (
 	"sync"
 
-	consul_api "github.com/hashicorp/consul/api"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
 )
 
@@ -33,6 +32,22 @@ type FakeRegistryAdapter struct {
 	syncReturns struct {
 		result1 error
 	}
+	RegisterExternalStub        func(service registry.ExternalRegistration) error
+	registerExternalMutex       sync.RWMutex
+	registerExternalArgsForCall []struct {
+		service registry.ExternalRegistration
+	}
+	registerExternalReturns struct {
+		result1 error
+	}
+	DeregisterExternalStub        func(service registry.ExternalRegistration) error
+	deregisterExternalMutex       sync.RWMutex
+	deregisterExternalArgsForCall []struct {
+		service registry.ExternalRegistration
+	}
+	deregisterExternalReturns struct {
+		result1 error
+	}
 	PingStub        func() error
 	pingMutex       sync.RWMutex
 	pingArgsForCall []struct{}
@@ -57,14 +72,14 @@ type FakeRegistryAdapter struct {
 	typeReturns struct {
 		result1 string
 	}
-	FindServiceStub        func(name, tag string) ([]*consul_api.CatalogService, error)
+	FindServiceStub        func(name, tag string) ([]*registry.Instance, error)
 	findServiceMutex       sync.RWMutex
 	findServiceArgsForCall []struct {
 		name string
 		tag  string
 	}
 	findServiceReturns struct {
-		result1 []*consul_api.CatalogService
+		result1 []*registry.Instance
 		result2 error
 	}
 	FindServicesStub        func() (map[string][]string, error)
@@ -74,7 +89,7 @@ type FakeRegistryAdapter struct {
 		result1 map[string][]string
 		result2 error
 	}
-	CheckServiceStub        func(name, tag string, passing bool) ([]*consul_api.ServiceEntry, error)
+	CheckServiceStub        func(name, tag string, passing bool) ([]*registry.HealthEntry, error)
 	checkServiceMutex       sync.RWMutex
 	checkServiceArgsForCall []struct {
 		name    string
@@ -82,7 +97,7 @@ type FakeRegistryAdapter struct {
 		passing bool
 	}
 	checkServiceReturns struct {
-		result1 []*consul_api.ServiceEntry
+		result1 []*registry.HealthEntry
 		result2 error
 	}
 }
@@ -183,6 +198,70 @@ func (fake *FakeRegistryAdapter) SyncReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeRegistryAdapter) RegisterExternal(service registry.ExternalRegistration) error {
+	fake.registerExternalMutex.Lock()
+	fake.registerExternalArgsForCall = append(fake.registerExternalArgsForCall, struct {
+		service registry.ExternalRegistration
+	}{service})
+	fake.registerExternalMutex.Unlock()
+	if fake.RegisterExternalStub != nil {
+		return fake.RegisterExternalStub(service)
+	} else {
+		return fake.registerExternalReturns.result1
+	}
+}
+
+func (fake *FakeRegistryAdapter) RegisterExternalCallCount() int {
+	fake.registerExternalMutex.RLock()
+	defer fake.registerExternalMutex.RUnlock()
+	return len(fake.registerExternalArgsForCall)
+}
+
+func (fake *FakeRegistryAdapter) RegisterExternalArgsForCall(i int) registry.ExternalRegistration {
+	fake.registerExternalMutex.RLock()
+	defer fake.registerExternalMutex.RUnlock()
+	return fake.registerExternalArgsForCall[i].service
+}
+
+func (fake *FakeRegistryAdapter) RegisterExternalReturns(result1 error) {
+	fake.RegisterExternalStub = nil
+	fake.registerExternalReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeRegistryAdapter) DeregisterExternal(service registry.ExternalRegistration) error {
+	fake.deregisterExternalMutex.Lock()
+	fake.deregisterExternalArgsForCall = append(fake.deregisterExternalArgsForCall, struct {
+		service registry.ExternalRegistration
+	}{service})
+	fake.deregisterExternalMutex.Unlock()
+	if fake.DeregisterExternalStub != nil {
+		return fake.DeregisterExternalStub(service)
+	} else {
+		return fake.deregisterExternalReturns.result1
+	}
+}
+
+func (fake *FakeRegistryAdapter) DeregisterExternalCallCount() int {
+	fake.deregisterExternalMutex.RLock()
+	defer fake.deregisterExternalMutex.RUnlock()
+	return len(fake.deregisterExternalArgsForCall)
+}
+
+func (fake *FakeRegistryAdapter) DeregisterExternalArgsForCall(i int) registry.ExternalRegistration {
+	fake.deregisterExternalMutex.RLock()
+	defer fake.deregisterExternalMutex.RUnlock()
+	return fake.deregisterExternalArgsForCall[i].service
+}
+
+func (fake *FakeRegistryAdapter) DeregisterExternalReturns(result1 error) {
+	fake.DeregisterExternalStub = nil
+	fake.deregisterExternalReturns = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeRegistryAdapter) Ping() error {
 	fake.pingMutex.Lock()
 	fake.pingArgsForCall = append(fake.pingArgsForCall, struct{}{})
@@ -279,7 +358,7 @@ func (fake *FakeRegistryAdapter) TypeReturns(result1 string) {
 	}{result1}
 }
 
-func (fake *FakeRegistryAdapter) FindService(name string, tag string) ([]*consul_api.CatalogService, error) {
+func (fake *FakeRegistryAdapter) FindService(name string, tag string) ([]*registry.Instance, error) {
 	fake.findServiceMutex.Lock()
 	fake.findServiceArgsForCall = append(fake.findServiceArgsForCall, struct {
 		name string
@@ -305,10 +384,10 @@ func (fake *FakeRegistryAdapter) FindServiceArgsForCall(i int) (string, string)
 	return fake.findServiceArgsForCall[i].name, fake.findServiceArgsForCall[i].tag
 }
 
-func (fake *FakeRegistryAdapter) FindServiceReturns(result1 []*consul_api.CatalogService, result2 error) {
+func (fake *FakeRegistryAdapter) FindServiceReturns(result1 []*registry.Instance, result2 error) {
 	fake.FindServiceStub = nil
 	fake.findServiceReturns = struct {
-		result1 []*consul_api.CatalogService
+		result1 []*registry.Instance
 		result2 error
 	}{result1, result2}
 }
@@ -338,7 +417,7 @@ func (fake *FakeRegistryAdapter) FindServicesReturns(result1 map[string][]string
 	}{result1, result2}
 }
 
-func (fake *FakeRegistryAdapter) CheckService(name string, tag string, passing bool) ([]*consul_api.ServiceEntry, error) {
+func (fake *FakeRegistryAdapter) CheckService(name string, tag string, passing bool) ([]*registry.HealthEntry, error) {
 	fake.checkServiceMutex.Lock()
 	fake.checkServiceArgsForCall = append(fake.checkServiceArgsForCall, struct {
 		name    string
@@ -365,10 +444,10 @@ func (fake *FakeRegistryAdapter) CheckServiceArgsForCall(i int) (string, string,
 	return fake.checkServiceArgsForCall[i].name, fake.checkServiceArgsForCall[i].tag, fake.checkServiceArgsForCall[i].passing
 }
 
-func (fake *FakeRegistryAdapter) CheckServiceReturns(result1 []*consul_api.ServiceEntry, result2 error) {
+func (fake *FakeRegistryAdapter) CheckServiceReturns(result1 []*registry.HealthEntry, result2 error) {
 	fake.CheckServiceStub = nil
 	fake.checkServiceReturns = struct {
-		result1 []*consul_api.ServiceEntry
+		result1 []*registry.HealthEntry
 		result2 error
 	}{result1, result2}
 }
@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrInvalidKey     = errors.New("key must not be blank or begin with a '/'")
+	ErrKVNotSupported = errors.New("registry adapter does not support a key/value store")
+)
+
+// KVPair is a single entry in the registry's key/value store. ModifyIndex
+// changes on every write and is what CAS compares against. Session is the
+// id of the session holding the key as a lock, if any.
+type KVPair struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	ModifyIndex uint64
+	Session     string
+}
+
+// KV is a key/value store backed by the registry. Keys are slash separated
+// paths and List and DeletePrefix operate on every key under a prefix.
+type KV interface {
+	// Get returns ErrKeyNotFound when key does not exist.
+	Get(key string) (*KVPair, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	DeletePrefix(prefix string) error
+	List(prefix string) ([]*KVPair, error)
+	// CAS writes pair only if the stored ModifyIndex still matches. A zero
+	// ModifyIndex only writes when the key does not exist yet.
+	CAS(pair *KVPair) (bool, error)
+	// WatchList is a blocking List. It returns once the store has changed
+	// past index or wait has elapsed, along with the index to pass to the
+	// next call. A zero index returns immediately.
+	WatchList(prefix string, index uint64, wait time.Duration) ([]*KVPair, uint64, error)
+}
+
+// NewKV returns the key/value store of adapter, or ErrKVNotSupported when the
+// backend does not provide one.
+func NewKV(adapter RegistryAdapter) (KV, error) {
+	kv, ok := adapter.(KV)
+	if !ok {
+		return nil, ErrKVNotSupported
+	}
+	return kv, nil
+}
+
+func validKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, "/")
+}
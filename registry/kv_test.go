@@ -0,0 +1,128 @@
+package registry_test
+
+import (
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func behavesLikeKV(newKV func() registry.KV) {
+	var kv registry.KV
+
+	BeforeEach(func() {
+		kv = newKV()
+		Expect(kv.DeletePrefix("platform-test/")).To(Succeed())
+	})
+
+	It("should put, get and delete a key", func() {
+		_, err := kv.Get("platform-test/flags/beta")
+		Expect(err).To(Equal(registry.ErrKeyNotFound))
+
+		Expect(kv.Put("platform-test/flags/beta", []byte("on"))).To(Succeed())
+
+		pair, err := kv.Get("platform-test/flags/beta")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(pair.Value)).To(Equal("on"))
+		Expect(pair.ModifyIndex).ToNot(BeZero())
+
+		Expect(kv.Delete("platform-test/flags/beta")).To(Succeed())
+
+		_, err = kv.Get("platform-test/flags/beta")
+		Expect(err).To(Equal(registry.ErrKeyNotFound))
+	})
+
+	It("should list and delete every key under a prefix", func() {
+		Expect(kv.Put("platform-test/flags/a", []byte("1"))).To(Succeed())
+		Expect(kv.Put("platform-test/flags/b", []byte("2"))).To(Succeed())
+		Expect(kv.Put("platform-test/timeouts/c", []byte("3"))).To(Succeed())
+
+		pairs, err := kv.List("platform-test/flags/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pairs).To(HaveLen(2))
+		Expect(pairs[0].Key).To(Equal("platform-test/flags/a"))
+		Expect(pairs[1].Key).To(Equal("platform-test/flags/b"))
+
+		Expect(kv.DeletePrefix("platform-test/flags/")).To(Succeed())
+
+		pairs, err = kv.List("platform-test/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pairs).To(HaveLen(1))
+	})
+
+	It("should only write with CAS when the modify index matches", func() {
+		ok, err := kv.CAS(&registry.KVPair{Key: "platform-test/owner", Value: []byte("a")})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		ok, err = kv.CAS(&registry.KVPair{Key: "platform-test/owner", Value: []byte("b")})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeFalse())
+
+		pair, err := kv.Get("platform-test/owner")
+		Expect(err).ToNot(HaveOccurred())
+
+		pair.Value = []byte("c")
+		ok, err = kv.CAS(pair)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		ok, err = kv.CAS(pair)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeFalse())
+
+		pair, err = kv.Get("platform-test/owner")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(pair.Value)).To(Equal("c"))
+	})
+
+	It("should block a watch until the store changes", func() {
+		Expect(kv.Put("platform-test/flags/a", []byte("1"))).To(Succeed())
+
+		pairs, index, err := kv.WatchList("platform-test/flags/", 0, time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pairs).To(HaveLen(1))
+		Expect(index).ToNot(BeZero())
+
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(100 * time.Millisecond)
+			Expect(kv.Put("platform-test/flags/b", []byte("2"))).To(Succeed())
+		}()
+
+		pairs, next, err := kv.WatchList("platform-test/flags/", index, 3*time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pairs).To(HaveLen(2))
+		Expect(next).To(BeNumerically(">", index))
+	})
+
+	It("should reject keys beginning with a slash", func() {
+		Expect(kv.Put("/platform-test", []byte("x"))).To(Equal(registry.ErrInvalidKey))
+	})
+}
+
+var _ = Describe("KV", func() {
+	It("should not be supported by adapters without a key/value store", func() {
+		_, err := registry.NewKV(new(fakes.FakeRegistryAdapter))
+		Expect(err).To(Equal(registry.ErrKVNotSupported))
+	})
+
+	Context("memory adapter", func() {
+		behavesLikeKV(func() registry.KV {
+			kv, err := registry.NewKV(registry.NewMemoryAdapter())
+			Expect(err).ToNot(HaveOccurred())
+			return kv
+		})
+	})
+
+	Context("consul adapter", func() {
+		behavesLikeKV(func() registry.KV {
+			kv, err := registry.NewKV(r)
+			Expect(err).ToNot(HaveOccurred())
+			return kv
+		})
+	})
+})
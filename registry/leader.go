@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+// How long to wait before campaigning again after the lock returned an error
+const defaultElectionRetryTime = 5 * time.Second
+
+// LeaderElector campaigns for a lock so that exactly one instance of a
+// service runs some piece of work at a time.
+type LeaderElector struct {
+	lock   *Lock
+	leader bool
+	quit   chan struct{}
+	done   chan struct{}
+	mtx    *sync.Mutex
+}
+
+// NewLeaderElector returns an elector campaigning on key, or
+// ErrLocksNotSupported when the adapter cannot hold locks.
+func NewLeaderElector(adapter RegistryAdapter, key string, opts LockOptions) (*LeaderElector, error) {
+	lock, err := NewLock(adapter, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &LeaderElector{lock: lock, mtx: &sync.Mutex{}}, nil
+}
+
+// Start campaigns in the background until Stop is called. Every time this
+// instance is elected, onElected is called in its own goroutine with a
+// channel that is closed when leadership is lost or the elector stops. The
+// elector waits for onElected to return before campaigning again or giving
+// up the lock, so onElected must return once the channel is closed.
+func (e *LeaderElector) Start(onElected func(lost <-chan struct{})) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.quit != nil {
+		return
+	}
+	e.quit = make(chan struct{})
+	e.done = make(chan struct{})
+
+	go e.campaign(onElected, e.quit, e.done)
+}
+
+// Stop ends the campaign and gives up leadership if it is held. It returns
+// once the last onElected call has returned.
+func (e *LeaderElector) Stop() {
+	e.mtx.Lock()
+	quit, done := e.quit, e.done
+	e.quit, e.done = nil, nil
+	e.mtx.Unlock()
+
+	if quit == nil {
+		return
+	}
+	close(quit)
+	<-done
+}
+
+// IsLeader reports whether this instance currently holds leadership.
+func (e *LeaderElector) IsLeader() bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.leader
+}
+
+func (e *LeaderElector) campaign(onElected func(<-chan struct{}), quit, done chan struct{}) {
+	defer close(done)
+
+	for {
+		lost, err := e.lock.Lock(quit)
+		if err != nil {
+			platform.Logger.Infof("unable to campaign for %s: %s", e.lock.key, err)
+			select {
+			case <-time.After(defaultElectionRetryTime):
+				continue
+			case <-quit:
+				return
+			}
+		}
+		if lost == nil {
+			return
+		}
+
+		platform.Logger.Infof("elected leader for %s", e.lock.key)
+		e.setLeader(true)
+
+		// onElected sees leadership end before the lock is released, so its
+		// work is over by the time another instance can be elected
+		term := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			onElected(term)
+		}()
+
+		stopped := false
+		select {
+		case <-lost:
+			platform.Logger.Warnf("lost leadership for %s", e.lock.key)
+		case <-quit:
+			stopped = true
+		}
+
+		close(term)
+		e.setLeader(false)
+		<-finished
+
+		if stopped {
+			e.lock.Unlock()
+			return
+		}
+	}
+}
+
+func (e *LeaderElector) setLeader(val bool) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.leader = val
+}
@@ -0,0 +1,352 @@
+package registry
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+const (
+	defaultLockSessionName = "platform lock"
+	defaultLockSessionTTL  = 15 * time.Second
+
+	// How long a single blocking query on the lock key waits. Backends may
+	// clamp this to stay under their request timeout.
+	defaultLockWaitTime = 10 * time.Second
+
+	// How long to wait before trying again when the lock is free but could
+	// not be acquired, for example while a lock-delay is in effect.
+	defaultLockRetryTime = 5 * time.Second
+)
+
+var (
+	ErrLocksNotSupported = errors.New("registry adapter does not support locks")
+	ErrLockHeld          = errors.New("lock already held")
+	ErrLockNotHeld       = errors.New("lock not held")
+	ErrSessionExpired    = errors.New("session expired")
+)
+
+// Sessions is implemented by adapters that can hold locks. A session stays
+// alive as long as it is renewed within its TTL, and every key it holds is
+// released when it expires or is destroyed.
+type Sessions interface {
+	// CreateSession starts a session that is also invalidated as soon as
+	// one of checks, given as registry check ids, goes critical.
+	CreateSession(name string, ttl time.Duration, checks []string) (string, error)
+	// RenewSession returns ErrSessionExpired once the session is gone.
+	RenewSession(id string) error
+	DestroySession(id string) error
+	// AcquireKey writes value to key and marks it as held by session. It
+	// returns false when another session already holds the key.
+	AcquireKey(key string, value []byte, session string) (bool, error)
+	ReleaseKey(key string, session string) (bool, error)
+	// WatchLock blocks until the key changes past index or wait elapses, and
+	// returns the session holding the key, which is blank when it is free.
+	WatchLock(key string, index uint64, wait time.Duration) (string, uint64, error)
+}
+
+// LockOptions tunes a Lock. Zero values use the defaults.
+type LockOptions struct {
+	// Value is written to the lock key while the lock is held.
+	Value       []byte
+	SessionName string
+	// SessionTTL bounds how long the lock outlives a process that stopped
+	// renewing it. Consul requires at least 10s.
+	SessionTTL time.Duration
+	// Checks ties the session to registry health checks, such as the
+	// heartbeat check of the service holding the lock, so the lock is
+	// released once the holder is unhealthy.
+	Checks []string
+}
+
+// Lock is a distributed mutex on a single key. The lock is tied to a session
+// that is renewed in the background, so it is lost if the process can no
+// longer reach the registry within the session TTL.
+type Lock struct {
+	sessions  Sessions
+	key       string
+	opts      LockOptions
+	held      bool
+	acquiring bool
+	session   string
+	lost      chan struct{}
+	quit      chan struct{}
+	mtx       *sync.Mutex
+}
+
+// NewLock returns a lock on key, or ErrLocksNotSupported when the adapter
+// cannot hold locks.
+func NewLock(adapter RegistryAdapter, key string, opts LockOptions) (*Lock, error) {
+	sessions, ok := adapter.(Sessions)
+	if !ok {
+		return nil, ErrLocksNotSupported
+	}
+
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	if opts.SessionName == "" {
+		opts.SessionName = defaultLockSessionName
+	}
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = defaultLockSessionTTL
+	}
+
+	return &Lock{sessions: sessions, key: key, opts: opts, mtx: &sync.Mutex{}}, nil
+}
+
+// Lock blocks until the lock is acquired or stop is closed. It returns a
+// channel that is closed when the lock is lost or released, or a nil channel
+// if stop was closed first. Holding the lock is never guaranteed: callers
+// must stop doing exclusive work as soon as the channel is closed.
+func (l *Lock) Lock(stop <-chan struct{}) (<-chan struct{}, error) {
+	l.mtx.Lock()
+	if l.held || l.acquiring {
+		l.mtx.Unlock()
+		return nil, ErrLockHeld
+	}
+	l.acquiring = true
+	l.mtx.Unlock()
+
+	session, err := l.acquire(stop)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.acquiring = false
+
+	if err != nil || session == "" {
+		return nil, err
+	}
+
+	platform.Logger.Infof("acquired lock %s", l.key)
+
+	l.held = true
+	l.session = session
+	l.lost = make(chan struct{})
+	l.quit = make(chan struct{})
+
+	go l.renew(session, l.quit)
+	go l.monitor(session, l.quit)
+
+	return l.lost, nil
+}
+
+// acquire creates a session and waits until it holds the lock key. It
+// returns a blank session if stop was closed first.
+func (l *Lock) acquire(stop <-chan struct{}) (string, error) {
+	session, err := l.sessions.CreateSession(l.opts.SessionName, l.opts.SessionTTL, l.opts.Checks)
+	if err != nil {
+		return "", err
+	}
+
+	var index uint64
+	free := false
+	for {
+		select {
+		case <-stop:
+			l.sessions.DestroySession(session)
+			return "", nil
+		default:
+		}
+
+		ok, err := l.sessions.AcquireKey(l.key, l.opts.Value, session)
+		if err != nil {
+			l.sessions.DestroySession(session)
+			return "", err
+		}
+		if ok {
+			return session, nil
+		}
+
+		if free {
+			// the key was free and we still could not take it, which
+			// means a lock-delay is in effect after a previous holder
+			select {
+			case <-time.After(defaultLockRetryTime):
+			case <-stop:
+			}
+		}
+
+		// wake up in time to renew the session while we wait
+		wait := defaultLockWaitTime
+		if wait > l.opts.SessionTTL/2 {
+			wait = l.opts.SessionTTL / 2
+		}
+
+		// run the blocking query aside so that stop is noticed right away
+		watch := make(chan lockWatch, 1)
+		go func(index uint64) {
+			holder, next, err := l.sessions.WatchLock(l.key, index, wait)
+			watch <- lockWatch{holder, next, err}
+		}(index)
+
+		var w lockWatch
+		select {
+		case w = <-watch:
+		case <-stop:
+			l.sessions.DestroySession(session)
+			return "", nil
+		}
+
+		if w.err != nil {
+			l.sessions.DestroySession(session)
+			return "", w.err
+		}
+		free = w.holder == ""
+		index = w.index
+
+		// keep the session alive while we wait
+		err = l.sessions.RenewSession(session)
+		if err == ErrSessionExpired {
+			session, err = l.sessions.CreateSession(l.opts.SessionName, l.opts.SessionTTL, l.opts.Checks)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			l.sessions.DestroySession(session)
+			return "", err
+		}
+	}
+}
+
+type lockWatch struct {
+	holder string
+	index  uint64
+	err    error
+}
+
+// Unlock releases the lock and destroys its session.
+func (l *Lock) Unlock() error {
+	l.mtx.Lock()
+	if !l.held {
+		l.mtx.Unlock()
+		return ErrLockNotHeld
+	}
+
+	close(l.quit)
+	l.release()
+	session := l.session
+	l.mtx.Unlock()
+
+	_, err := l.sessions.ReleaseKey(l.key, session)
+	l.sessions.DestroySession(session)
+
+	platform.Logger.Infof("released lock %s", l.key)
+	return err
+}
+
+// Held reports whether the lock is currently held.
+func (l *Lock) Held() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.held
+}
+
+// renew keeps the session alive until quit is closed and marks the lock lost
+// if that fails.
+func (l *Lock) renew(session string, quit chan struct{}) {
+	err := keepAlive(l.sessions, session, l.opts.SessionTTL, quit)
+	if err != nil {
+		platform.Logger.Warnf("lost lock %s: %s", l.key, err)
+		l.lose(session)
+	}
+}
+
+// monitor watches the lock key until quit is closed and marks the lock lost
+// as soon as another session, or nobody, holds it.
+func (l *Lock) monitor(session string, quit chan struct{}) {
+	var index uint64
+
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		holder, next, err := l.sessions.WatchLock(l.key, index, defaultLockWaitTime)
+
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		if err != nil {
+			// renew decides when errors have lasted long enough to lose the lock
+			platform.Logger.Debugf("unable to watch lock %s: %s", l.key, err)
+			select {
+			case <-time.After(time.Second):
+			case <-quit:
+				return
+			}
+			index = 0
+			continue
+		}
+
+		if holder != session {
+			platform.Logger.Warnf("lost lock %s: held by session %q", l.key, holder)
+			l.lose(session)
+			return
+		}
+		index = next
+	}
+}
+
+// lose marks the lock as no longer held if session is still the one holding
+// it, and cleans the session up.
+func (l *Lock) lose(session string) {
+	l.mtx.Lock()
+	if !l.held || l.session != session {
+		l.mtx.Unlock()
+		return
+	}
+
+	close(l.quit)
+	l.release()
+	l.mtx.Unlock()
+
+	l.sessions.DestroySession(session)
+}
+
+// release marks the lock as no longer held. Callers must hold the lock's
+// mutex.
+func (l *Lock) release() {
+	l.held = false
+	close(l.lost)
+}
+
+// keepAlive renews session until quit is closed, returning nil, or until the
+// session is gone. A session is considered gone once a full TTL passes
+// without a successful renewal, since the registry will have expired it by
+// then.
+func keepAlive(sessions Sessions, session string, ttl time.Duration, quit chan struct{}) error {
+	wait := ttl / 2
+	lastRenew := time.Now()
+
+	for {
+		select {
+		case <-time.After(wait):
+		case <-quit:
+			return nil
+		}
+
+		err := sessions.RenewSession(session)
+		if err == nil {
+			wait = ttl / 2
+			lastRenew = time.Now()
+			continue
+		}
+		wait = time.Second
+
+		if err == ErrSessionExpired || time.Since(lastRenew) > ttl {
+			return err
+		}
+		platform.Logger.Debugf("unable to renew session %s: %s", session, err)
+	}
+}
@@ -0,0 +1,261 @@
+package registry_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func behavesLikeLocker(newAdapter func() registry.RegistryAdapter, ttl time.Duration) {
+	var adapter registry.RegistryAdapter
+	var opts registry.LockOptions
+
+	BeforeEach(func() {
+		adapter = newAdapter()
+		opts = registry.LockOptions{SessionTTL: ttl}
+	})
+
+	It("should only let one holder lock a key at a time", func() {
+		a, err := registry.NewLock(adapter, "platform-test/lock", opts)
+		Expect(err).ToNot(HaveOccurred())
+		b, err := registry.NewLock(adapter, "platform-test/lock", opts)
+		Expect(err).ToNot(HaveOccurred())
+
+		lostA, err := a.Lock(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(lostA).ToNot(BeNil())
+		Expect(a.Held()).To(BeTrue())
+
+		_, err = a.Lock(nil)
+		Expect(err).To(Equal(registry.ErrLockHeld))
+
+		acquired := make(chan (<-chan struct{}), 1)
+		go func() {
+			defer GinkgoRecover()
+			lost, err := b.Lock(nil)
+			Expect(err).ToNot(HaveOccurred())
+			acquired <- lost
+		}()
+
+		Consistently(acquired, 500*time.Millisecond).ShouldNot(Receive())
+
+		Expect(a.Unlock()).To(Succeed())
+		Expect(lostA).To(BeClosed())
+		Expect(a.Unlock()).To(Equal(registry.ErrLockNotHeld))
+
+		var lostB <-chan struct{}
+		Eventually(acquired, 10*time.Second).Should(Receive(&lostB))
+		Expect(b.Held()).To(BeTrue())
+
+		Expect(b.Unlock()).To(Succeed())
+		Expect(lostB).To(BeClosed())
+	})
+
+	It("should give up waiting when stopped", func() {
+		a, err := registry.NewLock(adapter, "platform-test/lock", opts)
+		Expect(err).ToNot(HaveOccurred())
+		b, err := registry.NewLock(adapter, "platform-test/lock", opts)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = a.Lock(nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer a.Unlock()
+
+		stop := make(chan struct{})
+		done := make(chan (<-chan struct{}), 1)
+		go func() {
+			defer GinkgoRecover()
+			lost, err := b.Lock(stop)
+			Expect(err).ToNot(HaveOccurred())
+			done <- lost
+		}()
+
+		close(stop)
+
+		var lost <-chan struct{}
+		Eventually(done, 15*time.Second).Should(Receive(&lost))
+		Expect(lost).To(BeNil())
+		Expect(b.Held()).To(BeFalse())
+	})
+}
+
+// flakySessions fails renewals with renewErr and holds DestroySession until
+// destroying is closed.
+type flakySessions struct {
+	*registry.MemoryAdapter
+	renewErr   error
+	destroying chan struct{}
+	destroyed  []string
+	mtx        sync.Mutex
+}
+
+func (f *flakySessions) RenewSession(id string) error {
+	if f.renewErr != nil {
+		return f.renewErr
+	}
+	return f.MemoryAdapter.RenewSession(id)
+}
+
+func (f *flakySessions) DestroySession(id string) error {
+	if f.destroying != nil {
+		<-f.destroying
+	}
+	f.mtx.Lock()
+	f.destroyed = append(f.destroyed, id)
+	f.mtx.Unlock()
+	return f.MemoryAdapter.DestroySession(id)
+}
+
+func (f *flakySessions) Destroyed() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string(nil), f.destroyed...)
+}
+
+var _ = Describe("Lock", func() {
+	It("should not be supported by adapters without sessions", func() {
+		_, err := registry.NewLock(new(fakes.FakeRegistryAdapter), "platform-test/lock", registry.LockOptions{})
+		Expect(err).To(Equal(registry.ErrLocksNotSupported))
+	})
+
+	Context("memory adapter", func() {
+		behavesLikeLocker(func() registry.RegistryAdapter {
+			return registry.NewMemoryAdapter()
+		}, 200*time.Millisecond)
+
+		It("should report the lock as lost when its session expires", func() {
+			m := registry.NewMemoryAdapter()
+			lock, err := registry.NewLock(m, "platform-test/lock", registry.LockOptions{SessionTTL: 200 * time.Millisecond})
+			Expect(err).ToNot(HaveOccurred())
+
+			lost, err := lock.Lock(nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			// renewals keep the lock alive well past the TTL
+			Consistently(lost, 500*time.Millisecond).ShouldNot(BeClosed())
+
+			pair, err := m.Get("platform-test/lock")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.DestroySession(pair.Session)).To(Succeed())
+
+			Eventually(lost).Should(BeClosed())
+			Expect(lock.Held()).To(BeFalse())
+		})
+
+		It("should destroy its session when renewing it fails while waiting", func() {
+			flaky := &flakySessions{MemoryAdapter: registry.NewMemoryAdapter(), renewErr: errors.New("agent unavailable")}
+			opts := registry.LockOptions{SessionTTL: 200 * time.Millisecond}
+
+			holder, err := registry.NewLock(flaky.MemoryAdapter, "platform-test/lock", opts)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = holder.Lock(nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer holder.Unlock()
+
+			waiter, err := registry.NewLock(flaky, "platform-test/lock", opts)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = waiter.Lock(nil)
+			Expect(err).To(Equal(flaky.renewErr))
+
+			Expect(flaky.Destroyed()).To(HaveLen(1))
+			Expect(flaky.MemoryAdapter.RenewSession(flaky.Destroyed()[0])).To(Equal(registry.ErrSessionExpired))
+		})
+
+		It("should not block callers while it destroys a lost session", func() {
+			flaky := &flakySessions{MemoryAdapter: registry.NewMemoryAdapter(), destroying: make(chan struct{})}
+			defer close(flaky.destroying)
+
+			lock, err := registry.NewLock(flaky, "platform-test/lock", registry.LockOptions{SessionTTL: 200 * time.Millisecond})
+			Expect(err).ToNot(HaveOccurred())
+			lost, err := lock.Lock(nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			pair, err := flaky.Get("platform-test/lock")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(flaky.MemoryAdapter.DestroySession(pair.Session)).To(Succeed())
+			Eventually(lost).Should(BeClosed())
+
+			held := make(chan bool, 1)
+			go func() {
+				held <- lock.Held()
+			}()
+			Eventually(held, 500*time.Millisecond).Should(Receive(BeFalse()))
+			Expect(lock.Unlock()).To(Equal(registry.ErrLockNotHeld))
+		})
+	})
+
+	Context("consul adapter", func() {
+		behavesLikeLocker(func() registry.RegistryAdapter {
+			return r
+		}, 10*time.Second)
+	})
+})
+
+var _ = Describe("LeaderElector", func() {
+	var m *registry.MemoryAdapter
+	var opts registry.LockOptions
+
+	BeforeEach(func() {
+		m = registry.NewMemoryAdapter()
+		opts = registry.LockOptions{SessionTTL: 200 * time.Millisecond}
+	})
+
+	It("should elect a single leader and hand over when it stops", func() {
+		a, err := registry.NewLeaderElector(m, "platform-test/leader", opts)
+		Expect(err).ToNot(HaveOccurred())
+		b, err := registry.NewLeaderElector(m, "platform-test/leader", opts)
+		Expect(err).ToNot(HaveOccurred())
+
+		elected := make(chan string, 2)
+		run := func(name string) func(<-chan struct{}) {
+			return func(lost <-chan struct{}) {
+				elected <- name
+				<-lost
+			}
+		}
+
+		a.Start(run("a"))
+		Eventually(elected).Should(Receive(Equal("a")))
+		Expect(a.IsLeader()).To(BeTrue())
+
+		b.Start(run("b"))
+		Consistently(elected, 500*time.Millisecond).ShouldNot(Receive())
+		Expect(b.IsLeader()).To(BeFalse())
+
+		a.Stop()
+		Expect(a.IsLeader()).To(BeFalse())
+
+		Eventually(elected).Should(Receive(Equal("b")))
+		Expect(b.IsLeader()).To(BeTrue())
+
+		b.Stop()
+		Expect(b.IsLeader()).To(BeFalse())
+	})
+
+	It("should campaign again after losing leadership", func() {
+		e, err := registry.NewLeaderElector(m, "platform-test/leader", opts)
+		Expect(err).ToNot(HaveOccurred())
+
+		terms := make(chan struct{}, 2)
+		e.Start(func(lost <-chan struct{}) {
+			terms <- struct{}{}
+			<-lost
+		})
+		defer e.Stop()
+
+		Eventually(terms).Should(Receive())
+
+		pair, err := m.Get("platform-test/leader")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.DestroySession(pair.Session)).To(Succeed())
+
+		Eventually(terms).Should(Receive())
+		Expect(e.IsLeader()).To(BeTrue())
+	})
+})
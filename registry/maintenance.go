@@ -0,0 +1,17 @@
+package registry
+
+import "errors"
+
+// Prefix of the critical check the registry adds to a service in maintenance
+const MaintenanceCheckPrefix = "_service_maintenance:"
+
+var ErrMaintenanceNotSupported = errors.New("registry adapter does not support maintenance mode")
+
+// Maintenance is implemented by adapters that can take a registered service
+// out of discovery without deregistering it. A service in maintenance has a
+// critical check, so it is no longer returned as passing, and it stays in
+// maintenance when it is registered again.
+type Maintenance interface {
+	EnableMaintenance(sr ServiceRegistration, reason string) error
+	DisableMaintenance(sr ServiceRegistration) error
+}
@@ -0,0 +1,94 @@
+package registry_test
+
+import (
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func behavesLikeMaintenance(newAdapter func() registry.RegistryAdapter) {
+	var adapter registry.RegistryAdapter
+	var maintenance registry.Maintenance
+	var sr registry.ServiceRegistration
+
+	passing := func() int {
+		adapter.Sync(sr)
+		entries, err := adapter.CheckService("maintained", "", true)
+		Expect(err).ToNot(HaveOccurred())
+		return len(entries)
+	}
+
+	BeforeEach(func() {
+		adapter = newAdapter()
+		var ok bool
+		maintenance, ok = adapter.(registry.Maintenance)
+		Expect(ok).To(BeTrue())
+
+		sr = registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "maintained1", Name: "maintained", TTL: "10s"}
+		Expect(adapter.Register(sr)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		adapter.DeRegister(sr)
+	})
+
+	It("should take a service out of discovery without deregistering it", func() {
+		Eventually(passing, TIMEOUT).Should(Equal(1))
+
+		Expect(maintenance.EnableMaintenance(sr, "upgrading")).To(Succeed())
+		Eventually(passing, TIMEOUT).Should(Equal(0))
+
+		entries, err := adapter.CheckService("maintained", "", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+
+		var check *registry.HealthCheck
+		for _, c := range entries[0].Checks {
+			if c.ID == registry.MaintenanceCheckPrefix+sr.Id {
+				check = c
+			}
+		}
+		Expect(check).ToNot(BeNil())
+		Expect(check.Status).To(Equal(registry.HealthCritical))
+
+		Expect(maintenance.DisableMaintenance(sr)).To(Succeed())
+		Eventually(passing, TIMEOUT).Should(Equal(1))
+	})
+
+	It("should stay in maintenance when the service registers again", func() {
+		Expect(maintenance.EnableMaintenance(sr, "upgrading")).To(Succeed())
+		Expect(adapter.Register(sr)).To(Succeed())
+
+		Consistently(passing).Should(Equal(0))
+
+		Expect(maintenance.DisableMaintenance(sr)).To(Succeed())
+		Eventually(passing, TIMEOUT).Should(Equal(1))
+	})
+}
+
+var _ = Describe("Maintenance", func() {
+	It("should not be supported by every adapter", func() {
+		_, ok := registry.RegistryAdapter(new(fakes.FakeRegistryAdapter)).(registry.Maintenance)
+		Expect(ok).To(BeFalse())
+	})
+
+	Context("memory adapter", func() {
+		behavesLikeMaintenance(func() registry.RegistryAdapter {
+			return registry.NewMemoryAdapter()
+		})
+
+		It("should refuse maintenance for unknown services", func() {
+			m := registry.NewMemoryAdapter()
+			sr := registry.ServiceRegistration{Id: "unknown1", Name: "unknown"}
+			Expect(m.EnableMaintenance(sr, "")).ToNot(Succeed())
+		})
+	})
+
+	Context("consul adapter", func() {
+		behavesLikeMaintenance(func() registry.RegistryAdapter {
+			return r
+		})
+	})
+})
@@ -0,0 +1,285 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+const MEMORY_TYPE = "memory"
+
+// MemoryAdapter is an in-process RegistryAdapter. It keeps registrations in a
+// map and evaluates their TTL checks locally, which makes it useful for tests
+// and for running a service without a registry.
+type MemoryAdapter struct {
+	services    map[string]*memoryService
+	maintenance map[string]string
+	kv          map[string]*KVPair
+	kvIndex     uint64
+	kvChanged   chan struct{}
+	sessions    map[string]*memorySession
+	events      []*Event
+	eventIndex  uint64
+	eventFired  chan struct{}
+	ttl         time.Duration
+	deregister  time.Duration
+	mtx         *sync.RWMutex
+}
+
+type memoryService struct {
+	registration ServiceRegistration
+	ttl          time.Duration
+	deregister   time.Duration
+	registered   time.Time
+	lastSync     time.Time
+	// external services sit on their own node and have no checks
+	node     string
+	external bool
+}
+
+func NewMemoryAdapter() *MemoryAdapter {
+	return &MemoryAdapter{
+		services:    make(map[string]*memoryService),
+		maintenance: make(map[string]string),
+		kv:          make(map[string]*KVPair),
+		kvIndex:     1,
+		kvChanged:   make(chan struct{}),
+		sessions:    make(map[string]*memorySession),
+		eventFired:  make(chan struct{}),
+		eventIndex:  1,
+		ttl:         DefaultRefreshTTL,
+		mtx:         &sync.RWMutex{},
+	}
+}
+
+func (m *MemoryAdapter) Register(sr ServiceRegistration) error {
+	if sr.Id == "" || sr.Name == "" {
+		return ErrInvalidServiceRegistration
+	}
+
+	ttl, err := sr.ttlOr(m.ttl)
+	if err != nil {
+		return err
+	}
+
+	deregister := m.deregister
+	if sr.DeregisterCriticalAfter != "" {
+		deregister, err = time.ParseDuration(sr.DeregisterCriticalAfter)
+		if err != nil {
+			return fmt.Errorf("invalid deregister critical after %s: %v", sr.DeregisterCriticalAfter, err)
+		}
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.services[sr.Id] = &memoryService{registration: sr, ttl: ttl, deregister: deregister, registered: time.Now()}
+	return nil
+}
+
+func (m *MemoryAdapter) DeRegister(sr ServiceRegistration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.services, sr.Id)
+	delete(m.maintenance, sr.Id)
+	return nil
+}
+
+func (m *MemoryAdapter) Sync(sr ServiceRegistration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s, ok := m.services[sr.Id]
+	if !ok {
+		return fmt.Errorf("service %s is not registered", sr.Id)
+	}
+	s.lastSync = time.Now()
+	return nil
+}
+
+func (m *MemoryAdapter) Ping() error {
+	return nil
+}
+
+func (m *MemoryAdapter) Status() int {
+	return StatusConnected
+}
+
+func (m *MemoryAdapter) Disconnected() bool {
+	return false
+}
+
+// SubscribeStatus never calls fn, since the memory adapter is always
+// connected.
+func (m *MemoryAdapter) SubscribeStatus(fn StatusHandler) func() {
+	return func() {}
+}
+
+func (m *MemoryAdapter) LastStatusChange() StatusChange {
+	return StatusChange{From: StatusConnected, To: StatusConnected}
+}
+
+func (m *MemoryAdapter) Type() string {
+	return MEMORY_TYPE
+}
+
+func (m *MemoryAdapter) FindServices() (map[string][]string, error) {
+	m.expireCritical()
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	services := make(map[string][]string)
+	for _, s := range m.services {
+		tags := services[s.registration.Name]
+		if tags == nil {
+			tags = make([]string, 0)
+		}
+		services[s.registration.Name] = append(tags, s.registration.Tags...)
+	}
+	return services, nil
+}
+
+func (m *MemoryAdapter) FindService(name, tag string) ([]*Instance, error) {
+	m.expireCritical()
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	instances := make([]*Instance, 0)
+	for _, s := range m.sorted(name) {
+		instance := s.instance()
+		if tag != "" && !instance.HasTag(tag) {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+
+	if len(instances) == 0 {
+		platform.Logger.Debugf("service %s not found", name)
+		return nil, ErrServiceNotFound
+	}
+	return instances, nil
+}
+
+func (m *MemoryAdapter) CheckService(name, tag string, passing bool) ([]*HealthEntry, error) {
+	m.expireCritical()
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	entries := make([]*HealthEntry, 0)
+	for _, s := range m.sorted(name) {
+		instance := s.instance()
+		if tag != "" && !instance.HasTag(tag) {
+			continue
+		}
+		entry := &HealthEntry{Instance: instance, Checks: s.checks()}
+		if reason, ok := m.maintenance[s.registration.Id]; ok {
+			entry.Checks = append(entry.Checks, s.maintenanceCheck(reason))
+		}
+		if passing && !entry.Passing() {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// expireCritical deregisters services whose heartbeat has been critical for
+// longer than their DeregisterCriticalAfter, as consul does.
+func (m *MemoryAdapter) expireCritical() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+	for id, s := range m.services {
+		if !s.external && s.deregister > 0 && now.Sub(s.criticalSince()) > s.deregister {
+			platform.Logger.Infof("deregistering service %s after being critical for %v", id, s.deregister)
+			delete(m.services, id)
+			delete(m.maintenance, id)
+		}
+	}
+}
+
+// sorted returns the registrations for name ordered by id so lookups are
+// deterministic. Callers must hold the read lock.
+func (m *MemoryAdapter) sorted(name string) []*memoryService {
+	ids := make([]string, 0)
+	for id, s := range m.services {
+		if s.registration.Name == name {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	services := make([]*memoryService, 0, len(ids))
+	for _, id := range ids {
+		services = append(services, m.services[id])
+	}
+	return services
+}
+
+func (s *memoryService) instance() *Instance {
+	node := s.node
+	if node == "" {
+		node = MEMORY_TYPE
+	}
+	return &Instance{
+		ID:      s.registration.Id,
+		Name:    s.registration.Name,
+		Node:    node,
+		Address: s.registration.AdvertiseAddr,
+		Port:    s.registration.Port,
+		Tags:    s.registration.Tags,
+	}
+}
+
+// criticalSince returns when the heartbeat last expired, or when the service
+// registered if it never synced.
+func (s *memoryService) criticalSince() time.Time {
+	if s.lastSync.IsZero() {
+		return s.registered
+	}
+	return s.lastSync.Add(s.ttl)
+}
+
+// checks reports the TTL heartbeat and any declared TTL checks as passing
+// while the registration has synced within its TTL. Other declared checks
+// are listed but not executed, and are always reported as passing.
+func (s *memoryService) checks() []*HealthCheck {
+	if s.external {
+		return []*HealthCheck{}
+	}
+
+	status := HealthCritical
+	if !s.lastSync.IsZero() && time.Since(s.lastSync) <= s.ttl {
+		status = HealthPassing
+	}
+
+	key := "service:" + s.registration.Id
+	if len(s.registration.Checks) == 0 {
+		return []*HealthCheck{s.check(key, status)}
+	}
+
+	checks := []*HealthCheck{s.check(fmt.Sprintf("%s:%d", key, 1), status)}
+	for i, c := range s.registration.Checks {
+		checkStatus := HealthPassing
+		if c.Type == CheckTTL {
+			checkStatus = status
+		}
+		checks = append(checks, s.check(fmt.Sprintf("%s:%d", key, i+2), checkStatus))
+	}
+	return checks
+}
+
+func (s *memoryService) check(id, status string) *HealthCheck {
+	return &HealthCheck{
+		ID:        id,
+		Name:      "Service '" + s.registration.Name + "' check",
+		Status:    status,
+		ServiceID: s.registration.Id,
+	}
+}
@@ -0,0 +1,65 @@
+package registry_test
+
+import (
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryAdapter", func() {
+	var m registry.RegistryAdapter
+	var sr registry.ServiceRegistration
+
+	BeforeEach(func() {
+		var err error
+		m, err = registry.NewBackend(registry.Config{AdapterURI: "memory://"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Type()).To(Equal(registry.MEMORY_TYPE))
+
+		sr = registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", Tags: []string{"v1"}, TTL: "100ms"}
+	})
+
+	It("should register/deregister a service", func() {
+		Expect(m.Register(sr)).To(Succeed())
+
+		services, err := m.FindServices()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(services).To(HaveKey("bifrost"))
+
+		instances, err := m.FindService("bifrost", "v1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instances).To(HaveLen(1))
+		Expect(instances[0].HostPort()).To(Equal("127.0.0.1:3001"))
+
+		_, err = m.FindService("bifrost", "v2")
+		Expect(err).To(HaveOccurred())
+
+		Expect(m.DeRegister(sr)).To(Succeed())
+
+		_, err = m.FindService("bifrost", "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should only report passing instances that have synced within their TTL", func() {
+		Expect(m.Register(sr)).To(Succeed())
+
+		entries, err := m.CheckService("bifrost", "", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Passing()).To(BeFalse())
+
+		Expect(m.Sync(sr)).To(Succeed())
+
+		entries, err = m.CheckService("bifrost", "", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+
+		Eventually(func() int {
+			entries, _ := m.CheckService("bifrost", "", true)
+			return len(entries)
+		}, 1*time.Second).Should(Equal(0))
+	})
+})
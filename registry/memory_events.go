@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Same size as the buffer a consul agent keeps
+const memoryEventBuffer = 256
+
+func (m *MemoryAdapter) FireEvent(name string, payload []byte) (string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.eventIndex++
+	e := &Event{
+		ID:      uuid.NewV4().String(),
+		Name:    name,
+		Payload: append([]byte(nil), payload...),
+		LTime:   m.eventIndex,
+	}
+
+	m.events = append(m.events, e)
+	if len(m.events) > memoryEventBuffer {
+		m.events = m.events[len(m.events)-memoryEventBuffer:]
+	}
+
+	close(m.eventFired)
+	m.eventFired = make(chan struct{})
+
+	return e.ID, nil
+}
+
+// WatchEvents returns right away for a zero index. The event index starts at
+// 1, as consul's does, so that callers always get an index to block on.
+func (m *MemoryAdapter) WatchEvents(name string, index uint64, wait time.Duration) ([]*Event, uint64, error) {
+	m.mtx.RLock()
+	fired := m.eventFired
+	if index != 0 && m.eventIndex == index {
+		m.mtx.RUnlock()
+
+		select {
+		case <-fired:
+		case <-time.After(wait):
+		}
+
+		m.mtx.RLock()
+	}
+	defer m.mtx.RUnlock()
+
+	events := make([]*Event, 0, len(m.events))
+	for _, e := range m.events {
+		if name == "" || e.Name == name {
+			c := *e
+			events = append(events, &c)
+		}
+	}
+	return events, m.eventIndex, nil
+}
@@ -0,0 +1,36 @@
+package registry
+
+func (m *MemoryAdapter) RegisterExternal(e ExternalRegistration) error {
+	if !e.Valid() {
+		return ErrInvalidServiceRegistration
+	}
+	e = e.withDefaults()
+
+	sr := ServiceRegistration{
+		Id:            e.Id,
+		Name:          e.Name,
+		Address:       e.Address,
+		AdvertiseAddr: e.Address,
+		Port:          e.Port,
+		Tags:          e.Tags,
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.services[e.Id] = &memoryService{registration: sr, node: e.Node, external: true}
+	return nil
+}
+
+func (m *MemoryAdapter) DeregisterExternal(e ExternalRegistration) error {
+	if !e.identified() {
+		return ErrInvalidServiceRegistration
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if s, ok := m.services[e.Id]; ok && s.external {
+		delete(m.services, e.Id)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+func (m *MemoryAdapter) Get(key string) (*KVPair, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	pair, ok := m.kv[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return copyKVPair(pair), nil
+}
+
+func (m *MemoryAdapter) Put(key string, value []byte) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.put(&KVPair{Key: key, Value: value})
+	return nil
+}
+
+func (m *MemoryAdapter) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.kv[key]; ok {
+		delete(m.kv, key)
+		m.changed()
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) DeletePrefix(prefix string) error {
+	if !validKey(prefix) {
+		return ErrInvalidKey
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	deleted := false
+	for key := range m.kv {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.kv, key)
+			deleted = true
+		}
+	}
+	if deleted {
+		m.changed()
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) List(prefix string) ([]*KVPair, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.list(prefix), nil
+}
+
+// WatchList wakes on any write to the store, not only writes under prefix,
+// so callers may see the same pairs under a new index. The store index starts
+// at 1, as consul's does, so that even an empty store returns an index to
+// block on.
+func (m *MemoryAdapter) WatchList(prefix string, index uint64, wait time.Duration) ([]*KVPair, uint64, error) {
+	timeout := time.After(wait)
+
+	for {
+		m.mtx.RLock()
+		changed := m.kvChanged
+		if index == 0 || m.kvIndex > index {
+			defer m.mtx.RUnlock()
+			return m.list(prefix), m.kvIndex, nil
+		}
+		m.mtx.RUnlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			m.mtx.RLock()
+			defer m.mtx.RUnlock()
+			return m.list(prefix), m.kvIndex, nil
+		}
+	}
+}
+
+// list returns copies of the pairs under prefix ordered by key. Callers must
+// hold the read lock.
+func (m *MemoryAdapter) list(prefix string) []*KVPair {
+	keys := make([]string, 0)
+	for key := range m.kv {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]*KVPair, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, copyKVPair(m.kv[key]))
+	}
+	return pairs
+}
+
+func (m *MemoryAdapter) CAS(pair *KVPair) (bool, error) {
+	if !validKey(pair.Key) {
+		return false, ErrInvalidKey
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var index uint64
+	if current, ok := m.kv[pair.Key]; ok {
+		index = current.ModifyIndex
+	}
+	if index != pair.ModifyIndex {
+		return false, nil
+	}
+
+	m.put(pair)
+	return true, nil
+}
+
+// put stores a copy of pair under a new modify index, keeping any session
+// that holds the key. Callers must hold the write lock.
+func (m *MemoryAdapter) put(pair *KVPair) {
+	m.changed()
+	stored := copyKVPair(pair)
+	stored.ModifyIndex = m.kvIndex
+	if current, ok := m.kv[pair.Key]; ok {
+		stored.Session = current.Session
+	}
+	m.kv[pair.Key] = stored
+}
+
+// changed bumps the store index and wakes every WatchList. Callers must hold
+// the write lock.
+func (m *MemoryAdapter) changed() {
+	m.kvIndex++
+	close(m.kvChanged)
+	m.kvChanged = make(chan struct{})
+}
+
+func copyKVPair(p *KVPair) *KVPair {
+	c := *p
+	c.Value = append([]byte(nil), p.Value...)
+	return &c
+}
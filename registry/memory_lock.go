@@ -0,0 +1,178 @@
+package registry
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+type memorySession struct {
+	name    string
+	ttl     time.Duration
+	checks  []string
+	expires time.Time
+}
+
+func (m *MemoryAdapter) CreateSession(name string, ttl time.Duration, checks []string) (string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	status := m.checkStatus()
+	for _, id := range checks {
+		s, ok := status[id]
+		if !ok {
+			return "", fmt.Errorf("missing check %s for session", id)
+		}
+		if s == HealthCritical {
+			return "", fmt.Errorf("check %s is in critical state", id)
+		}
+	}
+
+	id := uuid.NewV4().String()
+	m.sessions[id] = &memorySession{name: name, ttl: ttl, checks: checks, expires: time.Now().Add(ttl)}
+	return id, nil
+}
+
+func (m *MemoryAdapter) RenewSession(id string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.expireSessions()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return ErrSessionExpired
+	}
+	s.expires = time.Now().Add(s.ttl)
+	return nil
+}
+
+func (m *MemoryAdapter) DestroySession(id string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.destroySession(id)
+	return nil
+}
+
+func (m *MemoryAdapter) AcquireKey(key string, value []byte, session string) (bool, error) {
+	if !validKey(key) {
+		return false, ErrInvalidKey
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.expireSessions()
+
+	if _, ok := m.sessions[session]; !ok {
+		return false, ErrSessionExpired
+	}
+
+	if current, ok := m.kv[key]; ok && current.Session != "" && current.Session != session {
+		return false, nil
+	}
+
+	m.put(&KVPair{Key: key, Value: value})
+	m.kv[key].Session = session
+	return true, nil
+}
+
+func (m *MemoryAdapter) ReleaseKey(key string, session string) (bool, error) {
+	if !validKey(key) {
+		return false, ErrInvalidKey
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	current, ok := m.kv[key]
+	if !ok || current.Session != session {
+		return false, nil
+	}
+	m.release(key)
+	return true, nil
+}
+
+// WatchLock also wakes when the session holding key expires, since expiry
+// releases the key without a write.
+func (m *MemoryAdapter) WatchLock(key string, index uint64, wait time.Duration) (string, uint64, error) {
+	timeout := time.After(wait)
+
+	for {
+		m.mtx.Lock()
+		m.expireSessions()
+
+		var holder string
+		var modified uint64
+		if pair, ok := m.kv[key]; ok {
+			holder, modified = pair.Session, pair.ModifyIndex
+		}
+		if index == 0 || modified > index || (modified == 0 && m.kvIndex > index) {
+			next := m.kvIndex
+			m.mtx.Unlock()
+			return holder, next, nil
+		}
+
+		changed := m.kvChanged
+		var expiry <-chan time.Time
+		if s, ok := m.sessions[holder]; ok {
+			expiry = time.After(s.expires.Sub(time.Now()))
+		}
+		m.mtx.Unlock()
+
+		select {
+		case <-changed:
+		case <-expiry:
+		case <-timeout:
+			return holder, index, nil
+		}
+	}
+}
+
+// expireSessions destroys every session that outlived its TTL or whose
+// checks are no longer passing. Callers must hold the write lock.
+func (m *MemoryAdapter) expireSessions() {
+	now := time.Now()
+	status := m.checkStatus()
+	for id, s := range m.sessions {
+		if now.After(s.expires) {
+			m.destroySession(id)
+			continue
+		}
+		for _, check := range s.checks {
+			if status[check] != HealthPassing && status[check] != HealthWarning {
+				m.destroySession(id)
+				break
+			}
+		}
+	}
+}
+
+// checkStatus maps every check id to its current status. Callers must hold
+// the lock.
+func (m *MemoryAdapter) checkStatus() map[string]string {
+	status := make(map[string]string)
+	for _, s := range m.services {
+		for _, c := range s.checks() {
+			status[c.ID] = c.Status
+		}
+	}
+	return status
+}
+
+// destroySession removes a session and releases every key it holds. Callers
+// must hold the write lock.
+func (m *MemoryAdapter) destroySession(id string) {
+	delete(m.sessions, id)
+	for key, pair := range m.kv {
+		if pair.Session == id {
+			m.release(key)
+		}
+	}
+}
+
+// release clears the session holding key. Callers must hold the write lock.
+func (m *MemoryAdapter) release(key string) {
+	m.changed()
+	m.kv[key].Session = ""
+	m.kv[key].ModifyIndex = m.kvIndex
+}
@@ -0,0 +1,37 @@
+package registry
+
+import "fmt"
+
+func (m *MemoryAdapter) EnableMaintenance(sr ServiceRegistration, reason string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.services[sr.Id]; !ok {
+		return fmt.Errorf("service %s is not registered", sr.Id)
+	}
+	m.maintenance[sr.Id] = reason
+	return nil
+}
+
+func (m *MemoryAdapter) DisableMaintenance(sr ServiceRegistration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.services[sr.Id]; !ok {
+		return fmt.Errorf("service %s is not registered", sr.Id)
+	}
+	delete(m.maintenance, sr.Id)
+	return nil
+}
+
+// maintenanceCheck mirrors the critical check consul adds to a service in
+// maintenance.
+func (s *memoryService) maintenanceCheck(reason string) *HealthCheck {
+	return &HealthCheck{
+		ID:        MaintenanceCheckPrefix + s.registration.Id,
+		Name:      "Service Maintenance Mode",
+		Status:    HealthCritical,
+		Output:    reason,
+		ServiceID: s.registration.Id,
+	}
+}
@@ -0,0 +1,5 @@
+package registry
+
+func (m *MemoryAdapter) DeregisterInstance(instance *Instance) error {
+	return m.DeRegister(ServiceRegistration{Id: instance.ID})
+}
@@ -2,20 +2,70 @@ package registry
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"gitlab.vailsys.com/vail-cloud-services/platform"
 )
 
+const (
+	// Upper bound for the delay between reconnect attempts
+	defaultMaxBackoff = 1 * time.Minute
+
+	// How often the registration is compared against the registry catalog
+	defaultVerifyInterval = 30 * time.Second
+)
+
+type PulseState int
+
+const (
+	// PulseHealthy means the last heartbeat reached the registry.
+	PulseHealthy PulseState = iota
+	// PulseDegraded means heartbeats are failing but the registration has
+	// not outlived its TTL yet.
+	PulseDegraded
+	// PulseLost means no heartbeat succeeded within the TTL, so the service
+	// has most likely dropped out of discovery.
+	PulseLost
+)
+
+func (s PulseState) String() string {
+	switch s {
+	case PulseHealthy:
+		return "healthy"
+	case PulseDegraded:
+		return "degraded"
+	case PulseLost:
+		return "lost"
+	default:
+		return "invalid"
+	}
+}
+
+// PulseStatus is a snapshot of the pulser's view of its registration.
+type PulseStatus struct {
+	State     PulseState
+	LastBeat  time.Time
+	LastError string
+	Failures  int
+}
+
 type Pulse struct {
 	active       bool
 	interval     time.Duration
+	ttl          time.Duration
 	adapter      RegistryAdapter
 	registration ServiceRegistration
 	ticker       *time.Ticker
 	mtx          *sync.RWMutex
 	quit         chan int
+	status       PulseStatus
+	started      time.Time
+	backoff      time.Duration
+	retryAt      time.Time
+	verifyEvery  time.Duration
+	lastVerify   time.Time
 }
 
 func NewPulser(interval time.Duration, registration ServiceRegistration, adapter RegistryAdapter) (*Pulse, error) {
@@ -23,56 +73,283 @@ func NewPulser(interval time.Duration, registration ServiceRegistration, adapter
 		return nil, ErrInvalidServiceRegistration
 	}
 
-	//fix this to check ttl
-	dur, _ := time.ParseDuration(registration.TTL)
+	dur, err := registration.ttlOr(DefaultRefreshTTL)
+	if err != nil {
+		return nil, err
+	}
 
-	if interval > dur {
-		return nil, fmt.Errorf("must use pulse interval: %s greater then registration TTL %s", interval.String(), registration.TTL)
+	if interval <= 0 || interval >= dur {
+		return nil, fmt.Errorf("pulse interval %s must be shorter than the registration TTL %s", interval, dur)
 	}
 
-	return &Pulse{interval: interval, registration: registration, adapter: adapter, mtx: &sync.RWMutex{}}, nil
+	return &Pulse{interval: interval, ttl: dur, registration: registration, adapter: adapter, mtx: &sync.RWMutex{}, verifyEvery: defaultVerifyInterval}, nil
+}
+
+// SetVerifyInterval changes how often the pulser checks the registry catalog
+// for drift from its registration. A zero interval disables verification.
+func (p *Pulse) SetVerifyInterval(d time.Duration) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.verifyEvery = d
 }
 
 func (p *Pulse) Start() {
 	platform.Logger.Debugf("Starting heartbeat for app: %v", p.registration)
 	p.setStatus(true)
+	p.mtx.Lock()
+	p.started = time.Now()
+	p.status = PulseStatus{State: PulseHealthy}
+	p.backoff = 0
+	p.retryAt = time.Time{}
+	p.lastVerify = p.started
 	p.ticker = time.NewTicker(p.interval)
 	p.quit = make(chan int)
+	p.mtx.Unlock()
 	go p.Beat()
 }
 
 func (p *Pulse) Stop() {
 	platform.Logger.Debugf("Stopping heartbeat for app: %v", p.registration)
+	p.mtx.Lock()
 	close(p.quit)
 	p.ticker.Stop()
+	p.mtx.Unlock()
 	p.adapter.DeRegister(p.registration)
 	p.setStatus(false)
 }
 
+// Beat syncs the registration on every tick until the pulser is stopped.
+// Failures never end the loop: the pulser backs off, reconnects and
+// re-registers once the registry is reachable again.
 func (p *Pulse) Beat() {
+	p.mtx.RLock()
+	ticker, quit := p.ticker, p.quit
+	p.mtx.RUnlock()
+
 	for {
 		select {
-		case <-p.ticker.C:
-			//date race
-			if p.adapter.Status() == StatusDisconnected {
-				platform.Logger.Debugf("registry adapter connection unavailable")
-				p.adapter.Ping()
-				return
-			}
-			err := p.adapter.Sync(p.registration)
-			if err != nil {
-				platform.Logger.Infof("pulser beat has stopped %s", err)
-			}
-		case <-p.quit:
+		case <-ticker.C:
+			p.beat()
+		case <-quit:
 			platform.Logger.Infof("quiting the pulser beat")
 			return
 		}
 	}
 }
 
-func (p *Pulse) setStatus(val bool) {
+func (p *Pulse) beat() {
+	p.mtx.RLock()
+	retryAt := p.retryAt
+	p.mtx.RUnlock()
+
+	if time.Now().Before(retryAt) {
+		return
+	}
+
+	//date race
+	if p.adapter.Status() == StatusDisconnected {
+		platform.Logger.Debugf("registry adapter connection unavailable")
+		err := p.reregister()
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		p.succeed()
+		return
+	}
+
+	err := p.adapter.Sync(p.registration)
+	if err != nil {
+		platform.Logger.Infof("pulser sync for %s failed: %s", p.registration.Id, err)
+		err = p.reregister()
+		if err != nil {
+			p.fail(err)
+			return
+		}
+	}
+	p.succeed()
+
+	if p.verifyDue() {
+		p.verify()
+	}
+}
+
+func (p *Pulse) verifyDue() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.verifyEvery <= 0 || time.Since(p.lastVerify) < p.verifyEvery {
+		return false
+	}
+	p.lastVerify = time.Now()
+	return true
+}
+
+// verify looks the registration up in the registry catalog and re-registers
+// it when it was removed or mutated out-of-band.
+func (p *Pulse) verify() {
+	entries, err := p.adapter.CheckService(p.registration.Name, "", false)
+	if err != nil && err != ErrServiceNotFound {
+		platform.Logger.Debugf("unable to verify registration %s: %s", p.registration.Id, err)
+		return
+	}
+
+	var entry *HealthEntry
+	for _, e := range entries {
+		if e.Instance != nil && e.Instance.ID == p.registration.Id {
+			entry = e
+			break
+		}
+	}
+
+	drift := registrationDrift(p.registration, entry)
+	if len(drift) == 0 {
+		return
+	}
+
+	platform.Logger.Warnf("registration %s does not match the registry: %s", p.registration.Id, strings.Join(drift, ", "))
+
+	err = p.reregister()
+	if err != nil {
+		platform.Logger.Infof("unable to repair registration %s: %s", p.registration.Id, err)
+		p.fail(err)
+	}
+}
+
+// registrationDrift lists the differences between what was registered and
+// the catalog entry the registry returned for it.
+func registrationDrift(sr ServiceRegistration, entry *HealthEntry) []string {
+	if entry == nil {
+		return []string{"service is not registered"}
+	}
+
+	drift := make([]string, 0)
+	instance := entry.Instance
+
+	if instance.Name != sr.Name {
+		drift = append(drift, fmt.Sprintf("name %q != %q", instance.Name, sr.Name))
+	}
+	if instance.Address != sr.AdvertiseAddr {
+		drift = append(drift, fmt.Sprintf("address %q != %q", instance.Address, sr.AdvertiseAddr))
+	}
+	if instance.Port != sr.Port {
+		drift = append(drift, fmt.Sprintf("port %d != %d", instance.Port, sr.Port))
+	}
+	if !sameTags(instance.Tags, sr.Tags) {
+		drift = append(drift, fmt.Sprintf("tags %v != %v", instance.Tags, sr.Tags))
+	}
+
+	key := "service:" + sr.Id
+	checks := 0
+	for _, c := range entry.Checks {
+		if c.ServiceID == sr.Id && (c.ID == key || strings.HasPrefix(c.ID, key+":")) {
+			checks++
+		}
+	}
+	if checks != len(sr.Checks)+1 {
+		drift = append(drift, fmt.Sprintf("%d checks != %d", checks, len(sr.Checks)+1))
+	}
+
+	return drift
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, t := range a {
+		counts[t]++
+	}
+	for _, t := range b {
+		counts[t]--
+		if counts[t] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reregister reconnects to the registry and registers the service again. The
+// registry may have lost the registration (for example an agent restart that
+// wiped its state), so a plain sync is not enough to recover.
+func (p *Pulse) reregister() error {
+	err := p.adapter.Ping()
+	if err != nil {
+		return err
+	}
+
+	platform.Logger.Infof("re-registering service %s", p.registration.String())
+
+	err = p.adapter.Register(p.registration)
+	if err != nil {
+		return err
+	}
+
+	return p.adapter.Sync(p.registration)
+}
+
+func (p *Pulse) succeed() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.status.State != PulseHealthy {
+		platform.Logger.Infof("pulser for %s is %s after %d failures", p.registration.Id, PulseHealthy, p.status.Failures)
+	}
+
+	p.status = PulseStatus{State: PulseHealthy, LastBeat: time.Now()}
+	p.backoff = 0
+	p.retryAt = time.Time{}
+}
+
+func (p *Pulse) fail(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+
+	if p.backoff == 0 {
+		p.backoff = p.interval
+	} else {
+		p.backoff *= 2
+	}
+	if p.backoff > defaultMaxBackoff {
+		p.backoff = defaultMaxBackoff
+	}
+	p.retryAt = now.Add(p.backoff)
+
+	lastContact := p.status.LastBeat
+	if lastContact.IsZero() {
+		lastContact = p.started
+	}
+
+	state := PulseDegraded
+	if now.Sub(lastContact) > p.ttl {
+		state = PulseLost
+	}
+
+	if state != p.status.State {
+		platform.Logger.Infof("pulser for %s is %s: %s", p.registration.Id, state, err)
+	}
+
+	p.status.State = state
+	p.status.LastError = err.Error()
+	p.status.Failures++
+
+	platform.Logger.Debugf("pulser retrying in %v", p.backoff)
+}
+
+// Status returns the pulser's current state along with the time of the last
+// successful heartbeat and the last error seen.
+func (p *Pulse) Status() PulseStatus {
 	p.mtx.RLock()
 	defer p.mtx.RUnlock()
+	return p.status
+}
+
+func (p *Pulse) setStatus(val bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
 	p.active = val
 }
 
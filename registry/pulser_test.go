@@ -27,6 +27,28 @@ var _ = Describe("Pulser", func() {
 			sr := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", Tags: []string{"v1"}, TTL: "2s"}
 			_, err := registry.NewPulser(3*time.Second, sr, fakeAdapter)
 			Expect(err).To(HaveOccurred())
+
+			_, err = registry.NewPulser(2*time.Second, sr, fakeAdapter)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should check the interval against the default TTL when the registration has none", func() {
+			fakeAdapter := new(fakes.FakeRegistryAdapter)
+			sr := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost"}
+
+			_, err := registry.NewPulser(registry.DefaultRefreshInterval, sr, fakeAdapter)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = registry.NewPulser(registry.DefaultRefreshTTL, sr, fakeAdapter)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should throw an error for an unparseable TTL", func() {
+			fakeAdapter := new(fakes.FakeRegistryAdapter)
+			sr := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "soon"}
+
+			_, err := registry.NewPulser(1*time.Second, sr, fakeAdapter)
+			Expect(err).To(HaveOccurred())
 		})
 	})
 
@@ -66,6 +88,109 @@ var _ = Describe("Pulser", func() {
 
 			Expect(pulse.Active()).To(Equal(true))
 		})
+
+		It("should re-register when the registry has forgotten the service", func() {
+			fakeAdapter := new(fakes.FakeRegistryAdapter)
+			sr := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", Tags: []string{"v1"}, TTL: "1s"}
+
+			pulse, err := registry.NewPulser(100*time.Millisecond, sr, fakeAdapter)
+			Expect(err).ToNot(HaveOccurred())
+
+			fakeAdapter.StatusReturns(registry.StatusConnected)
+			fakeAdapter.SyncStub = func(registry.ServiceRegistration) error {
+				if fakeAdapter.RegisterCallCount() == 0 {
+					return registry.ErrSyncing
+				}
+				return nil
+			}
+
+			pulse.Start()
+			defer pulse.Stop()
+
+			Eventually(fakeAdapter.RegisterCallCount, TIMEOUT).Should(Equal(1))
+			Eventually(func() registry.PulseState {
+				return pulse.Status().State
+			}, TIMEOUT).Should(Equal(registry.PulseHealthy))
+			Expect(pulse.Status().LastBeat.IsZero()).To(BeFalse())
+		})
+
+		It("should keep reconnecting and report lost once the TTL has passed", func() {
+			fakeAdapter := new(fakes.FakeRegistryAdapter)
+			sr := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", Tags: []string{"v1"}, TTL: "300ms"}
+
+			pulse, err := registry.NewPulser(100*time.Millisecond, sr, fakeAdapter)
+			Expect(err).ToNot(HaveOccurred())
+
+			fakeAdapter.StatusReturns(registry.StatusDisconnected)
+			fakeAdapter.PingReturns(registry.ErrSyncing)
+
+			pulse.Start()
+			defer pulse.Stop()
+
+			Eventually(func() registry.PulseState {
+				return pulse.Status().State
+			}, TIMEOUT).Should(Equal(registry.PulseDegraded))
+			Eventually(func() registry.PulseState {
+				return pulse.Status().State
+			}, TIMEOUT).Should(Equal(registry.PulseLost))
+
+			status := pulse.Status()
+			Expect(status.LastError).To(Equal(registry.ErrSyncing.Error()))
+
+			fakeAdapter.PingReturns(nil)
+
+			Eventually(func() registry.PulseState {
+				return pulse.Status().State
+			}, TIMEOUT).Should(Equal(registry.PulseHealthy))
+			Expect(fakeAdapter.RegisterCallCount()).To(Equal(1))
+		})
 	})
 
+	Context("anti-entropy", func() {
+		var adapter *registry.MemoryAdapter
+		var sr registry.ServiceRegistration
+		var pulse *registry.Pulse
+
+		BeforeEach(func() {
+			adapter = registry.NewMemoryAdapter()
+			sr = registry.ServiceRegistration{Address: "127.0.0.1", AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", Tags: []string{"v1"}, TTL: "1s"}
+			Expect(adapter.Register(sr)).To(Succeed())
+
+			var err error
+			pulse, err = registry.NewPulser(100*time.Millisecond, sr, adapter)
+			Expect(err).ToNot(HaveOccurred())
+			pulse.SetVerifyInterval(100 * time.Millisecond)
+			pulse.Start()
+		})
+
+		AfterEach(func() {
+			pulse.Stop()
+		})
+
+		It("should restore a registration removed out-of-band", func() {
+			Expect(adapter.DeRegister(sr)).To(Succeed())
+
+			Eventually(func() error {
+				_, err := adapter.FindService("bifrost", "")
+				return err
+			}, TIMEOUT).ShouldNot(HaveOccurred())
+		})
+
+		It("should repair a registration mutated out-of-band", func() {
+			mutated := sr
+			mutated.Port = 4001
+			mutated.Tags = []string{"v2"}
+			Expect(adapter.Register(mutated)).To(Succeed())
+
+			Eventually(func() []string {
+				instances, err := adapter.FindService("bifrost", "")
+				Expect(err).ToNot(HaveOccurred())
+				return instances[0].Tags
+			}, TIMEOUT).Should(Equal([]string{"v1"}))
+
+			instances, err := adapter.FindService("bifrost", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instances[0].Port).To(Equal(3001))
+		})
+	})
 })
@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+// ID of the critical check consul adds to a node in maintenance
+const nodeMaintenanceCheckID = "_node_maintenance"
+
+var ErrReaperNotSupported = errors.New("registry adapter cannot deregister other instances")
+
+// InstanceDeregisterer is implemented by adapters that can remove any
+// instance of a service, including ones registered by other processes.
+type InstanceDeregisterer interface {
+	DeregisterInstance(instance *Instance) error
+}
+
+// Reaper deregisters the instances of a service that have been critical for
+// too long. It cleans up after instances that were killed before they could
+// deregister and that predate DeregisterCriticalAfter.
+type Reaper struct {
+	adapter  RegistryAdapter
+	dereg    InstanceDeregisterer
+	name     string
+	after    time.Duration
+	critical map[string]time.Time
+	quit     chan struct{}
+	done     chan struct{}
+	mtx      *sync.Mutex
+}
+
+// NewReaper returns a reaper for the instances of the named service that
+// stay critical for longer than after, or ErrReaperNotSupported when the
+// adapter cannot deregister them.
+func NewReaper(adapter RegistryAdapter, name string, after time.Duration) (*Reaper, error) {
+	dereg, ok := adapter.(InstanceDeregisterer)
+	if !ok {
+		return nil, ErrReaperNotSupported
+	}
+
+	return &Reaper{
+		adapter:  adapter,
+		dereg:    dereg,
+		name:     name,
+		after:    after,
+		critical: make(map[string]time.Time),
+		mtx:      &sync.Mutex{},
+	}, nil
+}
+
+// Reap checks the service's instances once and deregisters the ones that
+// have been critical for longer than the reaper's threshold. The registry
+// does not record when an instance went critical, so an instance is only
+// reaped once the reaper itself has seen it critical for that long. Instances
+// in maintenance are left alone. Reap returns the instances it removed.
+func (r *Reaper) Reap() ([]*Instance, error) {
+	entries, err := r.adapter.CheckService(r.name, "", false)
+	if err != nil && err != ErrServiceNotFound {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	reaped := make([]*Instance, 0)
+
+	for _, e := range entries {
+		if e.Instance == nil || !critical(e) {
+			continue
+		}
+		id := e.Instance.Node + "/" + e.Instance.ID
+		seen[id] = true
+
+		since, ok := r.critical[id]
+		if !ok {
+			r.critical[id] = now
+			continue
+		}
+		if now.Sub(since) <= r.after {
+			continue
+		}
+
+		err := r.dereg.DeregisterInstance(e.Instance)
+		if err != nil {
+			platform.Logger.Warnf("unable to reap instance %s of %s: %s", e.Instance.ID, r.name, err)
+			continue
+		}
+		platform.Logger.Infof("reaped instance %s of %s on %s after being critical for %v", e.Instance.ID, r.name, e.Instance.Node, now.Sub(since))
+		delete(r.critical, id)
+		reaped = append(reaped, e.Instance)
+	}
+
+	// forget instances that recovered or went away
+	for id := range r.critical {
+		if !seen[id] {
+			delete(r.critical, id)
+		}
+	}
+
+	return reaped, nil
+}
+
+// Start reaps every interval in the background until Stop is called.
+func (r *Reaper) Start(interval time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.quit != nil {
+		return
+	}
+	r.quit = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go r.loop(interval, r.quit, r.done)
+}
+
+// Stop ends a reaper started with Start.
+func (r *Reaper) Stop() {
+	r.mtx.Lock()
+	quit, done := r.quit, r.done
+	r.quit, r.done = nil, nil
+	r.mtx.Unlock()
+
+	if quit == nil {
+		return
+	}
+	close(quit)
+	<-done
+}
+
+func (r *Reaper) loop(interval time.Duration, quit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := r.Reap()
+			if err != nil {
+				platform.Logger.Debugf("unable to reap %s: %s", r.name, err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// critical reports whether the entry's heartbeat, the TTL check named by
+// HeartbeatCheckID, is critical for a reason other than maintenance. Its
+// other checks and the node's checks, such as serfHealth, are ignored: they
+// also fail on live instances, which must not be reaped.
+func critical(e *HealthEntry) bool {
+	for _, c := range e.Checks {
+		if c.ID == nodeMaintenanceCheckID || strings.HasPrefix(c.ID, MaintenanceCheckPrefix) {
+			return false
+		}
+	}
+
+	// the registry only numbers check ids when there is more than one
+	heartbeat := "service:" + e.Instance.ID
+	for _, c := range e.Checks {
+		if c.ID != heartbeat && c.ID != heartbeat+":1" {
+			continue
+		}
+		if c.Status == HealthCritical {
+			return true
+		}
+	}
+	return false
+}
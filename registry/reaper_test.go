@@ -0,0 +1,186 @@
+package registry_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+type deregisteringAdapter struct {
+	*fakes.FakeRegistryAdapter
+	deregistered []string
+}
+
+func (d *deregisteringAdapter) DeregisterInstance(instance *registry.Instance) error {
+	d.deregistered = append(d.deregistered, instance.ID)
+	return nil
+}
+
+var _ = Describe("Reaper", func() {
+	var m *registry.MemoryAdapter
+	var healthy, crashed registry.ServiceRegistration
+
+	BeforeEach(func() {
+		m = registry.NewMemoryAdapter()
+		healthy = registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "10s"}
+		crashed = registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3002, Id: "router2", Name: "bifrost", TTL: "10s"}
+		Expect(m.Register(healthy)).To(Succeed())
+		Expect(m.Sync(healthy)).To(Succeed())
+		Expect(m.Register(crashed)).To(Succeed())
+	})
+
+	It("should not be supported by every adapter", func() {
+		_, err := registry.NewReaper(new(fakes.FakeRegistryAdapter), "bifrost", time.Minute)
+		Expect(err).To(Equal(registry.ErrReaperNotSupported))
+	})
+
+	It("should deregister instances that stay critical past the threshold", func() {
+		reaper, err := registry.NewReaper(m, "bifrost", 100*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+
+		reaped, err := reaper.Reap()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reaped).To(BeEmpty())
+
+		time.Sleep(150 * time.Millisecond)
+
+		reaped, err = reaper.Reap()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reaped).To(HaveLen(1))
+		Expect(reaped[0].ID).To(Equal(crashed.Id))
+
+		instances, err := m.FindService("bifrost", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instances).To(HaveLen(1))
+		Expect(instances[0].ID).To(Equal(healthy.Id))
+	})
+
+	It("should leave instances in maintenance and instances that recover alone", func() {
+		Expect(m.EnableMaintenance(healthy, "upgrading")).To(Succeed())
+
+		reaper, err := registry.NewReaper(m, "bifrost", 100*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		reaper.Reap()
+
+		Expect(m.Sync(crashed)).To(Succeed())
+		reaper.Reap()
+
+		time.Sleep(150 * time.Millisecond)
+		reaped, err := reaper.Reap()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reaped).To(BeEmpty())
+	})
+
+	It("should only reap instances whose heartbeat is critical", func() {
+		entry := func(id string, checks ...*registry.HealthCheck) *registry.HealthEntry {
+			return &registry.HealthEntry{Instance: &registry.Instance{ID: id, Name: "bifrost", Node: "node1"}, Checks: checks}
+		}
+		check := func(id, serviceID, status string) *registry.HealthCheck {
+			return &registry.HealthCheck{ID: id, ServiceID: serviceID, Status: status}
+		}
+
+		adapter := &deregisteringAdapter{FakeRegistryAdapter: new(fakes.FakeRegistryAdapter)}
+		adapter.CheckServiceReturns([]*registry.HealthEntry{
+			entry("unhealthy", check("service:unhealthy:1", "unhealthy", registry.HealthPassing), check("service:unhealthy:2", "unhealthy", registry.HealthCritical)),
+			entry("flapping", check("serfHealth", "", registry.HealthCritical), check("service:flapping", "flapping", registry.HealthPassing)),
+			entry("stopped", check("service:stopped", "stopped", registry.HealthCritical)),
+			entry("crashed", check("service:crashed:1", "crashed", registry.HealthCritical), check("service:crashed:2", "crashed", registry.HealthPassing)),
+		}, nil)
+
+		reaper, err := registry.NewReaper(adapter, "bifrost", time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		reaper.Reap()
+		time.Sleep(5 * time.Millisecond)
+
+		reaped, err := reaper.Reap()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reaped).To(HaveLen(2))
+		Expect(adapter.deregistered).To(Equal([]string{"stopped", "crashed"}))
+	})
+
+	It("should reap in the background until stopped", func() {
+		reaper, err := registry.NewReaper(m, "bifrost", 100*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+
+		reaper.Start(50 * time.Millisecond)
+		defer reaper.Stop()
+
+		Eventually(func() int {
+			instances, _ := m.FindService("bifrost", "")
+			return len(instances)
+		}).Should(Equal(1))
+	})
+})
+
+var _ = Describe("DeregisterCriticalAfter", func() {
+	It("should deregister services critical for longer than their setting", func() {
+		m := registry.NewMemoryAdapter()
+		sr := registry.ServiceRegistration{Address: "127.0.0.1", AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "50ms", DeregisterCriticalAfter: "100ms"}
+		Expect(sr.Valid()).To(BeTrue())
+		Expect(m.Register(sr)).To(Succeed())
+		Expect(m.Sync(sr)).To(Succeed())
+
+		Consistently(func() error {
+			_, err := m.FindService("bifrost", "")
+			return err
+		}, 100*time.Millisecond).ShouldNot(HaveOccurred())
+
+		Eventually(func() error {
+			_, err := m.FindService("bifrost", "")
+			return err
+		}).Should(Equal(registry.ErrServiceNotFound))
+	})
+
+	It("should reject malformed durations", func() {
+		sr := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", DeregisterCriticalAfter: "later"}
+		Expect(sr.Valid()).To(BeFalse())
+	})
+
+	It("should be sent to consul on the heartbeat check", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.RouteToHandler("GET", "/v1/status/leader", ghttp.RespondWithJSONEncoded(http.StatusOK, "127.0.0.1:8300"))
+		server.RouteToHandler("GET", "/v1/status/peers", ghttp.RespondWithJSONEncoded(http.StatusOK, []string{}))
+
+		var body map[string]interface{}
+		server.RouteToHandler("PUT", "/v1/agent/service/register", func(w http.ResponseWriter, req *http.Request) {
+			defer GinkgoRecover()
+			Expect(json.NewDecoder(req.Body).Decode(&body)).To(Succeed())
+		})
+
+		adapter, err := registry.NewBackend(registry.Config{AdapterURI: "consul://" + server.Addr(), DeregisterCriticalAfter: 2 * time.Minute})
+		Expect(err).ToNot(HaveOccurred())
+
+		sr := registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "10s"}
+		Expect(adapter.Register(sr)).To(Succeed())
+		Expect(body["ID"]).To(Equal("router1"))
+		Expect(body["Check"]).To(HaveKeyWithValue("TTL", "10s"))
+		Expect(body["Check"]).To(HaveKeyWithValue("DeregisterCriticalServiceAfter", "2m0s"))
+
+		sr.DeregisterCriticalAfter = "90s"
+		sr.Checks = []registry.Check{registry.TTLCheck("30s")}
+		Expect(adapter.Register(sr)).To(Succeed())
+		checks := body["Checks"].([]interface{})
+		Expect(checks).To(HaveLen(2))
+		Expect(checks[0]).To(HaveKeyWithValue("DeregisterCriticalServiceAfter", "90s"))
+		Expect(checks[1]).ToNot(HaveKey("DeregisterCriticalServiceAfter"))
+	})
+
+	It("should be accepted by consul", func() {
+		sr := registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "reaped1", Name: "reaped", TTL: "10s", DeregisterCriticalAfter: "1m"}
+		Expect(r.Register(sr)).To(Succeed())
+		defer r.DeRegister(sr)
+
+		Eventually(func() error {
+			_, err := r.FindService("reaped", "")
+			return err
+		}, TIMEOUT).ShouldNot(HaveOccurred())
+	})
+})
@@ -6,16 +6,49 @@ import (
 )
 
 func NewBackend(config Config) (RegistryAdapter, error) {
-	uri, err := url.Parse(config.AdapterURI)
+	err := config.Validate()
 	if err != nil {
-		return nil, fmt.Errorf("Invalid adapter URI %v", err)
+		return nil, err
 	}
 
-	switch uri.Scheme {
-	case "consul":
-		adapter := NewConsulAdapter(uri)
-		return adapter, nil
+	rawURIs := config.AdapterURIs
+	if len(rawURIs) == 0 {
+		rawURIs = []string{config.AdapterURI}
+	}
+
+	uris := make([]*url.URL, 0, len(rawURIs))
+	for _, raw := range rawURIs {
+		uri, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid adapter URI %v", err)
+		}
+		if len(uris) > 0 && backendType(uri.Scheme) != backendType(uris[0].Scheme) {
+			return nil, fmt.Errorf("Invalid adapter URI %s, all adapter URIs must use the %s scheme", raw, uris[0].Scheme)
+		}
+		uris = append(uris, uri)
+	}
+
+	uri := uris[0]
+
+	switch backendType(uri.Scheme) {
+	case CONSUL_TYPE:
+		return NewConsulAdapter(config, uris...)
+	case MEMORY_TYPE:
+		m := NewMemoryAdapter()
+		m.ttl = config.TTL()
+		m.deregister = config.DeregisterCriticalAfter
+		return m, nil
 	default:
 		return nil, fmt.Errorf("Invalid adapter scheme %v", uri.Scheme)
 	}
 }
+
+// backendType maps an adapter URI scheme to the backend serving it.
+func backendType(scheme string) string {
+	switch scheme {
+	case CONSUL_TYPE, CONSUL_TLS_SCHEME:
+		return CONSUL_TYPE
+	default:
+		return scheme
+	}
+}
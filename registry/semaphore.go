@@ -0,0 +1,509 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+
+	"golang.org/x/net/context"
+)
+
+// Key under the semaphore prefix holding the limit and the current holders
+const semaphoreLockKey = ".lock"
+
+var (
+	ErrNoSlots           = errors.New("no semaphore slot available")
+	ErrSemaphoreConflict = errors.New("existing semaphore limit does not match")
+	ErrSlotNotHeld       = errors.New("semaphore slot not held")
+)
+
+// semaphoreLock is stored under the .lock key. It uses the layout of consul's
+// own semaphore, except that holders are named after their contender key
+// rather than their session since the slots of a semaphore share a session.
+type semaphoreLock struct {
+	Limit   int
+	Holders map[string]bool
+}
+
+// Semaphore limits how many holders, across every instance sharing the
+// prefix, can hold a slot at once. Every slot writes a contender key under
+// the prefix and is listed as a holder in the .lock key while it holds a
+// slot. The contender keys of a semaphore are all held by one session, which
+// is created with the first slot and renewed until Close.
+type Semaphore struct {
+	kv        KV
+	sessions  Sessions
+	prefix    string
+	limit     int
+	opts      LockOptions
+	slots     map[*Slot]struct{}
+	sessionID string
+	quit      chan struct{}
+	holders   uint64
+	mtx       *sync.Mutex
+}
+
+// Slot is a single acquired place in a semaphore.
+type Slot struct {
+	sem     *Semaphore
+	session string
+	holder  string
+	held    bool
+	lost    chan struct{}
+	quit    chan struct{}
+	mtx     *sync.Mutex
+}
+
+// NewSemaphore returns a semaphore allowing limit holders under prefix, or
+// ErrLocksNotSupported when the adapter cannot hold locks.
+func NewSemaphore(adapter RegistryAdapter, prefix string, limit int, opts LockOptions) (*Semaphore, error) {
+	sessions, ok := adapter.(Sessions)
+	if !ok {
+		return nil, ErrLocksNotSupported
+	}
+	kv, err := NewKV(adapter)
+	if err != nil {
+		return nil, ErrLocksNotSupported
+	}
+
+	if !validKey(prefix) {
+		return nil, ErrInvalidKey
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid semaphore limit %d", limit)
+	}
+
+	if opts.SessionName == "" {
+		opts.SessionName = defaultLockSessionName
+	}
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = defaultLockSessionTTL
+	}
+
+	return &Semaphore{
+		kv:       kv,
+		sessions: sessions,
+		prefix:   prefix,
+		limit:    limit,
+		opts:     opts,
+		slots:    make(map[*Slot]struct{}),
+		mtx:      &sync.Mutex{},
+	}, nil
+}
+
+// Acquire blocks until a slot is free or ctx is done, in which case it
+// returns ctx.Err().
+func (s *Semaphore) Acquire(ctx context.Context) (*Slot, error) {
+	return s.acquire(ctx, true)
+}
+
+// TryAcquire takes a slot if one is free and returns ErrNoSlots otherwise.
+func (s *Semaphore) TryAcquire() (*Slot, error) {
+	return s.acquire(context.Background(), false)
+}
+
+// Close releases every slot still held through the semaphore and destroys
+// its session.
+func (s *Semaphore) Close() {
+	for _, slot := range s.heldSlots("") {
+		slot.Release()
+	}
+
+	s.mtx.Lock()
+	session, quit := s.sessionID, s.quit
+	s.sessionID, s.quit = "", nil
+	s.mtx.Unlock()
+
+	if session != "" {
+		close(quit)
+		s.sessions.DestroySession(session)
+	}
+}
+
+// heldSlots returns the slots held with session, or every held slot when
+// session is blank.
+func (s *Semaphore) heldSlots(session string) []*Slot {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	slots := make([]*Slot, 0, len(s.slots))
+	for slot := range s.slots {
+		if session == "" || slot.session == session {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// session returns the session shared by the slots of the semaphore, creating
+// it and starting its renewal when there is none.
+func (s *Semaphore) session() (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.sessionID != "" {
+		return s.sessionID, nil
+	}
+
+	session, err := s.sessions.CreateSession(s.opts.SessionName, s.opts.SessionTTL, s.opts.Checks)
+	if err != nil {
+		return "", err
+	}
+	s.sessionID = session
+	s.quit = make(chan struct{})
+	s.holders = 0
+
+	go s.renew(session, s.quit)
+	return session, nil
+}
+
+func (s *Semaphore) renew(session string, quit chan struct{}) {
+	err := keepAlive(s.sessions, session, s.opts.SessionTTL, quit)
+	if err != nil {
+		platform.Logger.Warnf("lost the session of semaphore %s: %s", s.prefix, err)
+		s.expire(session)
+	}
+}
+
+// expire drops session, so that the next slot starts a new one, and loses
+// every slot held with it.
+func (s *Semaphore) expire(session string) {
+	s.mtx.Lock()
+	if s.sessionID == session {
+		close(s.quit)
+		s.sessionID, s.quit = "", nil
+	}
+	s.mtx.Unlock()
+
+	for _, slot := range s.heldSlots(session) {
+		slot.lose()
+	}
+}
+
+// current reports whether session is still the session of the semaphore.
+func (s *Semaphore) current(session string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sessionID == session
+}
+
+// contend writes a new contender key with the semaphore's session and
+// returns the session along with the holder name. A session that expired
+// before its renewal noticed is replaced once.
+func (s *Semaphore) contend() (string, string, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		var session string
+		session, err = s.session()
+		if err != nil {
+			return "", "", err
+		}
+
+		s.mtx.Lock()
+		s.holders++
+		holder := fmt.Sprintf("%s-%d", session, s.holders)
+		s.mtx.Unlock()
+
+		var ok bool
+		ok, err = s.sessions.AcquireKey(s.prefix+holder, s.opts.Value, session)
+		if err == nil && !ok {
+			err = fmt.Errorf("unable to write semaphore contender %s", s.prefix+holder)
+		}
+		if err == nil {
+			return session, holder, nil
+		}
+
+		if s.sessions.RenewSession(session) != ErrSessionExpired {
+			return "", "", err
+		}
+		s.expire(session)
+	}
+	return "", "", err
+}
+
+func (s *Semaphore) acquire(ctx context.Context, wait bool) (*Slot, error) {
+	session, holder, err := s.contend()
+	if err != nil {
+		return nil, err
+	}
+
+	var index uint64
+	for {
+		select {
+		case <-ctx.Done():
+			s.cleanup(holder)
+			return nil, ctx.Err()
+		default:
+		}
+
+		if !s.current(session) {
+			s.cleanup(holder)
+			return nil, ErrSessionExpired
+		}
+
+		// wake up in time to notice that the session expired
+		waitTime := defaultLockWaitTime
+		if waitTime > s.opts.SessionTTL/2 {
+			waitTime = s.opts.SessionTTL / 2
+		}
+
+		// run the blocking query aside so that cancellation is noticed
+		// right away
+		watch := make(chan semaphoreWatch, 1)
+		go func(index uint64) {
+			pairs, next, err := s.kv.WatchList(s.prefix, index, waitTime)
+			watch <- semaphoreWatch{pairs, next, err}
+		}(index)
+
+		var w semaphoreWatch
+		select {
+		case w = <-watch:
+		case <-ctx.Done():
+			s.cleanup(holder)
+			return nil, ctx.Err()
+		}
+
+		if w.err != nil {
+			s.cleanup(holder)
+			return nil, w.err
+		}
+		next := w.index
+
+		lock, modifyIndex, err := s.state(w.pairs)
+		if err != nil {
+			s.cleanup(holder)
+			return nil, err
+		}
+
+		if len(lock.Holders) < s.limit {
+			lock.Holders[holder] = true
+			ok, err := s.writeLock(lock, modifyIndex)
+			if err != nil {
+				s.cleanup(holder)
+				return nil, err
+			}
+			if ok {
+				return s.held(session, holder), nil
+			}
+			// somebody else changed the holders first, so read them again
+			index = 0
+			continue
+		}
+
+		if !wait {
+			s.cleanup(holder)
+			return nil, ErrNoSlots
+		}
+		index = next
+	}
+}
+
+type semaphoreWatch struct {
+	pairs []*KVPair
+	index uint64
+	err   error
+}
+
+// state reads the .lock key out of pairs and drops holders whose contender
+// key lost its session. It returns the lock along with the modify index to CAS against.
+func (s *Semaphore) state(pairs []*KVPair) (*semaphoreLock, uint64, error) {
+	lock := &semaphoreLock{Limit: s.limit, Holders: make(map[string]bool)}
+	live := make(map[string]bool)
+	var modifyIndex uint64
+
+	for _, p := range pairs {
+		if p.Key == s.prefix+semaphoreLockKey {
+			modifyIndex = p.ModifyIndex
+			err := json.Unmarshal(p.Value, lock)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid semaphore lock %s: %v", p.Key, err)
+			}
+			continue
+		}
+		if p.Session != "" {
+			live[strings.TrimPrefix(p.Key, s.prefix)] = true
+		}
+	}
+
+	if lock.Limit != s.limit {
+		return nil, 0, ErrSemaphoreConflict
+	}
+	if lock.Holders == nil {
+		lock.Holders = make(map[string]bool)
+	}
+
+	for holder := range lock.Holders {
+		if !live[holder] {
+			delete(lock.Holders, holder)
+		}
+	}
+
+	return lock, modifyIndex, nil
+}
+
+func (s *Semaphore) writeLock(lock *semaphoreLock, modifyIndex uint64) (bool, error) {
+	value, err := json.Marshal(lock)
+	if err != nil {
+		return false, err
+	}
+	return s.kv.CAS(&KVPair{Key: s.prefix + semaphoreLockKey, Value: value, ModifyIndex: modifyIndex})
+}
+
+func (s *Semaphore) held(session, holder string) *Slot {
+	slot := &Slot{
+		sem:     s,
+		session: session,
+		holder:  holder,
+		held:    true,
+		lost:    make(chan struct{}),
+		quit:    make(chan struct{}),
+		mtx:     &sync.Mutex{},
+	}
+
+	s.mtx.Lock()
+	s.slots[slot] = struct{}{}
+	s.mtx.Unlock()
+
+	platform.Logger.Debugf("acquired semaphore slot under %s", s.prefix)
+
+	go slot.monitor()
+
+	return slot
+}
+
+// cleanup removes a contender that never got or no longer holds a slot.
+func (s *Semaphore) cleanup(holder string) {
+	s.kv.Delete(s.prefix + holder)
+}
+
+// Lost returns a channel that is closed when the slot is lost or released.
+// Work guarded by the slot must stop once it is closed.
+func (slot *Slot) Lost() <-chan struct{} {
+	return slot.lost
+}
+
+// Held reports whether the slot is still held.
+func (slot *Slot) Held() bool {
+	slot.mtx.Lock()
+	defer slot.mtx.Unlock()
+	return slot.held
+}
+
+// Release gives the slot back so another holder can take it.
+func (slot *Slot) Release() error {
+	if !slot.release() {
+		return ErrSlotNotHeld
+	}
+
+	s := slot.sem
+	var err error
+	for i := 0; i < 3; i++ {
+		var pair *KVPair
+		pair, err = s.kv.Get(s.prefix + semaphoreLockKey)
+		if err == ErrKeyNotFound {
+			err = nil
+			break
+		}
+		if err != nil {
+			continue
+		}
+
+		lock := &semaphoreLock{}
+		err = json.Unmarshal(pair.Value, lock)
+		if err != nil {
+			break
+		}
+		if !lock.Holders[slot.holder] {
+			break
+		}
+		delete(lock.Holders, slot.holder)
+
+		var ok bool
+		ok, err = s.writeLock(lock, pair.ModifyIndex)
+		if ok || err != nil {
+			break
+		}
+	}
+
+	// deleting the contender releases the slot even if the .lock update
+	// failed, since holders without a live contender are ignored
+	s.cleanup(slot.holder)
+
+	platform.Logger.Debugf("released semaphore slot under %s", s.prefix)
+	return err
+}
+
+// release marks the slot as no longer held, reporting whether it was.
+func (slot *Slot) release() bool {
+	slot.mtx.Lock()
+	defer slot.mtx.Unlock()
+
+	if !slot.held {
+		return false
+	}
+	slot.held = false
+	close(slot.quit)
+	close(slot.lost)
+
+	slot.sem.mtx.Lock()
+	delete(slot.sem.slots, slot)
+	slot.sem.mtx.Unlock()
+	return true
+}
+
+// monitor watches the semaphore until the slot is released and marks it
+// lost once the session is no longer listed as a live holder.
+func (slot *Slot) monitor() {
+	s := slot.sem
+	var index uint64
+
+	for {
+		select {
+		case <-slot.quit:
+			return
+		default:
+		}
+
+		pairs, next, err := s.kv.WatchList(s.prefix, index, defaultLockWaitTime)
+
+		select {
+		case <-slot.quit:
+			return
+		default:
+		}
+
+		if err != nil {
+			platform.Logger.Debugf("unable to watch semaphore %s: %s", s.prefix, err)
+			select {
+			case <-time.After(time.Second):
+			case <-slot.quit:
+				return
+			}
+			index = 0
+			continue
+		}
+
+		lock, _, err := s.state(pairs)
+		if err != nil || !lock.Holders[slot.holder] {
+			platform.Logger.Warnf("lost semaphore slot under %s", s.prefix)
+			slot.lose()
+			return
+		}
+		index = next
+	}
+}
+
+func (slot *Slot) lose() {
+	if slot.release() {
+		slot.sem.cleanup(slot.holder)
+	}
+}
@@ -0,0 +1,160 @@
+package registry_test
+
+import (
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"golang.org/x/net/context"
+)
+
+func behavesLikeSemaphore(newAdapter func() registry.RegistryAdapter, ttl time.Duration) {
+	var sem *registry.Semaphore
+
+	BeforeEach(func() {
+		var err error
+		sem, err = registry.NewSemaphore(newAdapter(), "platform-test/exports", 2, registry.LockOptions{SessionTTL: ttl})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		sem.Close()
+	})
+
+	It("should hand out at most limit slots", func() {
+		a, err := sem.TryAcquire()
+		Expect(err).ToNot(HaveOccurred())
+		b, err := sem.TryAcquire()
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = sem.TryAcquire()
+		Expect(err).To(Equal(registry.ErrNoSlots))
+
+		Expect(a.Release()).To(Succeed())
+		Expect(a.Lost()).To(BeClosed())
+		Expect(a.Release()).To(Equal(registry.ErrSlotNotHeld))
+
+		c, err := sem.TryAcquire()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b.Held()).To(BeTrue())
+		Expect(c.Held()).To(BeTrue())
+	})
+
+	It("should block until a slot is free or the context is done", func() {
+		_, err := sem.TryAcquire()
+		Expect(err).ToNot(HaveOccurred())
+		held, err := sem.TryAcquire()
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, err = sem.Acquire(ctx)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+
+		acquired := make(chan *registry.Slot, 1)
+		go func() {
+			defer GinkgoRecover()
+			slot, err := sem.Acquire(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			acquired <- slot
+		}()
+
+		Consistently(acquired, 300*time.Millisecond).ShouldNot(Receive())
+		Expect(held.Release()).To(Succeed())
+		Eventually(acquired, 10*time.Second).Should(Receive())
+	})
+
+	It("should reject a different limit on the same prefix", func() {
+		_, err := sem.TryAcquire()
+		Expect(err).ToNot(HaveOccurred())
+
+		other, err := registry.NewSemaphore(newAdapter(), "platform-test/exports", 3, registry.LockOptions{SessionTTL: ttl})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = other.TryAcquire()
+		Expect(err).To(Equal(registry.ErrSemaphoreConflict))
+	})
+}
+
+var _ = Describe("Semaphore", func() {
+	It("should not be supported by adapters without sessions", func() {
+		_, err := registry.NewSemaphore(new(fakes.FakeRegistryAdapter), "platform-test/exports", 1, registry.LockOptions{})
+		Expect(err).To(Equal(registry.ErrLocksNotSupported))
+	})
+
+	Context("memory adapter", func() {
+		var m *registry.MemoryAdapter
+
+		BeforeEach(func() {
+			m = registry.NewMemoryAdapter()
+		})
+
+		behavesLikeSemaphore(func() registry.RegistryAdapter {
+			return m
+		}, 200*time.Millisecond)
+
+		It("should hold every slot with one session", func() {
+			sem, err := registry.NewSemaphore(m, "platform-test/exports", 2, registry.LockOptions{SessionTTL: 200 * time.Millisecond})
+			Expect(err).ToNot(HaveOccurred())
+			defer sem.Close()
+
+			a, err := sem.TryAcquire()
+			Expect(err).ToNot(HaveOccurred())
+			b, err := sem.TryAcquire()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b.Release()).To(Succeed())
+			c, err := sem.TryAcquire()
+			Expect(err).ToNot(HaveOccurred())
+
+			pairs, err := m.List("platform-test/exports/")
+			Expect(err).ToNot(HaveOccurred())
+			sessions := map[string]bool{}
+			for _, p := range pairs {
+				if p.Session != "" {
+					sessions[p.Session] = true
+				}
+			}
+			Expect(sessions).To(HaveLen(1))
+
+			// the shared session is renewed past its TTL
+			Consistently(func() bool {
+				return a.Held() && c.Held()
+			}, 500*time.Millisecond).Should(BeTrue())
+			_, err = sem.TryAcquire()
+			Expect(err).To(Equal(registry.ErrNoSlots))
+		})
+
+		It("should free the slot of a holder whose health check fails", func() {
+			sr := registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "300ms"}
+			Expect(m.Register(sr)).To(Succeed())
+
+			opts := registry.LockOptions{SessionTTL: 200 * time.Millisecond, Checks: []string{sr.HeartbeatCheckID()}}
+			sem, err := registry.NewSemaphore(m, "platform-test/exports", 1, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = sem.TryAcquire()
+			Expect(err).To(HaveOccurred())
+
+			Expect(m.Sync(sr)).To(Succeed())
+			slot, err := sem.TryAcquire()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(slot.Lost(), 2*time.Second).Should(BeClosed())
+
+			Expect(m.Sync(sr)).To(Succeed())
+			_, err = sem.TryAcquire()
+			Expect(err).ToNot(HaveOccurred())
+			sem.Close()
+		})
+	})
+
+	Context("consul adapter", func() {
+		behavesLikeSemaphore(func() registry.RegistryAdapter {
+			return r
+		}, 10*time.Second)
+	})
+})
@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"errors"
+	"runtime"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+)
+
+var ErrStatusNotSupported = errors.New("registry adapter does not report status changes")
+
+// StatusChange is a transition of an adapter's connection to its registry.
+type StatusChange struct {
+	From int
+	To   int
+	// Time the transition happened
+	Time time.Time
+	// LastError is the error that disconnected the adapter, if any
+	LastError string
+}
+
+func (c StatusChange) String() string {
+	return statusName(c.From) + " -> " + statusName(c.To)
+}
+
+// StatusHandler is called for every status transition of an adapter.
+type StatusHandler func(change StatusChange)
+
+// StatusNotifier is implemented by adapters that report when they connect to
+// or lose their registry, so callers can react instead of polling Status.
+type StatusNotifier interface {
+	// SubscribeStatus calls fn for every later transition, in order, until
+	// the returned cancel function is called. Handlers run outside of the
+	// adapter's locks and may call back into it, but they hold up delivery
+	// to other handlers and must not block.
+	SubscribeStatus(fn StatusHandler) (cancel func())
+	// LastStatusChange returns the most recent transition, or the initial
+	// status when there has been none.
+	LastStatusChange() StatusChange
+}
+
+// SubscribeStatus subscribes fn to the adapter's status transitions, or
+// returns ErrStatusNotSupported when the adapter cannot report them.
+func SubscribeStatus(adapter RegistryAdapter, fn StatusHandler) (func(), error) {
+	notifier, ok := adapter.(StatusNotifier)
+	if !ok {
+		return nil, ErrStatusNotSupported
+	}
+	return notifier.SubscribeStatus(fn), nil
+}
+
+func statusName(status int) string {
+	s := AdapterStatus{status: status}
+	return s.String()
+}
+
+// subscribe adds fn to the subscribers. Callers must hold the adapter lock.
+func (as *AdapterStatus) subscribe(fn StatusHandler) int {
+	if as.subscribers == nil {
+		as.subscribers = make(map[int]StatusHandler)
+	}
+	as.nextSubscriber++
+	as.subscribers[as.nextSubscriber] = fn
+	return as.nextSubscriber
+}
+
+// statusDelivery is a transition waiting to be delivered to the handlers
+// subscribed when it happened.
+type statusDelivery struct {
+	change   StatusChange
+	handlers []StatusHandler
+}
+
+// transition records a change to status and queues it for the handlers.
+// Callers must hold the adapter lock and call notify once they have released
+// it.
+func (as *AdapterStatus) transition(status int, err error) StatusChange {
+	change := StatusChange{From: as.status, To: status, Time: time.Now()}
+	if err != nil {
+		change.LastError = err.Error()
+	}
+
+	as.status = status
+	as.last = change
+
+	handlers := make([]StatusHandler, 0, len(as.subscribers))
+	for _, fn := range as.subscribers {
+		handlers = append(handlers, fn)
+	}
+
+	as.queue.Lock()
+	as.pending = append(as.pending, statusDelivery{change: change, handlers: handlers})
+	as.queue.Unlock()
+
+	return change
+}
+
+// notify delivers the queued transitions in the order they happened. Only one
+// caller delivers at a time: transitions queued meanwhile, including by the
+// handlers themselves, are delivered by that caller before it returns.
+func (as *AdapterStatus) notify() {
+	as.queue.Lock()
+	if as.delivering {
+		as.queue.Unlock()
+		return
+	}
+	as.delivering = true
+
+	for len(as.pending) > 0 {
+		d := as.pending[0]
+		as.pending = as.pending[1:]
+		as.queue.Unlock()
+
+		for _, fn := range d.handlers {
+			callStatusHandler(fn, d.change)
+		}
+
+		as.queue.Lock()
+	}
+
+	as.delivering = false
+	as.queue.Unlock()
+}
+
+func callStatusHandler(fn StatusHandler, change StatusChange) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			platform.Logger.Errorf("registry status handler panicked: %v\n%s", r, buf)
+		}
+	}()
+	fn(change)
+}
@@ -0,0 +1,111 @@
+package registry_test
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Status notifications", func() {
+	It("should not be supported by every adapter", func() {
+		_, err := registry.SubscribeStatus(new(fakes.FakeRegistryAdapter), func(registry.StatusChange) {})
+		Expect(err).To(Equal(registry.ErrStatusNotSupported))
+	})
+
+	It("should notify subscribers when the consul adapter loses its agent", func() {
+		server := ghttp.NewServer()
+		server.RouteToHandler("GET", "/v1/status/leader", ghttp.RespondWithJSONEncoded(http.StatusOK, "127.0.0.1:8300"))
+		server.RouteToHandler("GET", "/v1/status/peers", ghttp.RespondWithJSONEncoded(http.StatusOK, []string{}))
+
+		adapter, err := registry.NewBackend(registry.Config{AdapterURI: "consul://" + server.Addr()})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(adapter.Status()).To(Equal(registry.StatusConnected))
+
+		initial := adapter.(registry.StatusNotifier).LastStatusChange()
+		Expect(initial.From).To(Equal(registry.StatusDisconnected))
+		Expect(initial.To).To(Equal(registry.StatusConnected))
+
+		changes := make(chan registry.StatusChange, 4)
+		cancel, err := registry.SubscribeStatus(adapter, func(change registry.StatusChange) {
+			changes <- change
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		// nothing changes while the agent stays reachable
+		Expect(adapter.Ping()).To(Succeed())
+		Expect(changes).ToNot(Receive())
+
+		server.Close()
+		Expect(adapter.Ping()).ToNot(Succeed())
+
+		var change registry.StatusChange
+		Expect(changes).To(Receive(&change))
+		Expect(change.From).To(Equal(registry.StatusConnected))
+		Expect(change.To).To(Equal(registry.StatusDisconnected))
+		Expect(change.Time.After(initial.Time)).To(BeTrue())
+		Expect(change.LastError).ToNot(BeEmpty())
+		Expect(change.String()).To(Equal("connected -> disconnected"))
+		Expect(adapter.(registry.StatusNotifier).LastStatusChange()).To(Equal(change))
+
+		cancel()
+		Expect(adapter.Sync(registry.ServiceRegistration{Id: "router1"})).ToNot(Succeed())
+		Expect(changes).ToNot(Receive())
+	})
+
+	It("should deliver concurrent transitions in the order they happened", func() {
+		var calls int32
+		flapping := func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&calls, 1)%2 == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`"127.0.0.1:8300"`))
+		}
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.AllowUnhandledRequests = true
+		server.RouteToHandler("GET", "/v1/status/leader", flapping)
+		server.RouteToHandler("GET", "/v1/status/peers", ghttp.RespondWithJSONEncoded(http.StatusOK, []string{}))
+
+		adapter, err := registry.NewBackend(registry.Config{AdapterURI: "consul://" + server.Addr()})
+		Expect(err).ToNot(HaveOccurred())
+
+		mtx := &sync.Mutex{}
+		changes := make([]registry.StatusChange, 0)
+		_, err = registry.SubscribeStatus(adapter, func(change registry.StatusChange) {
+			time.Sleep(time.Millisecond)
+			mtx.Lock()
+			defer mtx.Unlock()
+			changes = append(changes, change)
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					adapter.Ping()
+				}
+			}()
+		}
+		wg.Wait()
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		Expect(len(changes)).To(BeNumerically(">", 1))
+		for i := 1; i < len(changes); i++ {
+			Expect(changes[i].From).To(Equal(changes[i-1].To))
+		}
+		Expect(changes[len(changes)-1]).To(Equal(adapter.(registry.StatusNotifier).LastStatusChange()))
+	})
+})
@@ -3,28 +3,116 @@ package registry
 import (
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	consul_api "github.com/hashicorp/consul/api"
+	"gitlab.vailsys.com/vail-cloud-services/platform"
 )
 
 var (
 	ErrInvalidServiceRegistration = errors.New("service registration is invalid")
 	ErrSyncing                    = errors.New("unable to sync with registry")
+	ErrServiceNotFound            = errors.New("service not found")
+)
+
+const (
+	// Heartbeat TTL of registrations that do not set one
+	DefaultRefreshTTL = 5 * time.Second
+	// Interval between heartbeats and publisher refreshes
+	DefaultRefreshInterval = 2 * time.Second
 )
 
 type Config struct {
-	AdapterURI      string
-	RefreshTTL      int
-	RefreshInterval int
+	AdapterURI string
+	// AdapterURIs lists every agent the adapter may fail over between. When
+	// set it takes precedence over AdapterURI.
+	AdapterURIs []string
+	// Token is the ACL token sent with every registry request. TokenFile is
+	// read for the token when Token is blank.
+	Token     string
+	TokenFile string
+	TLS       TLSConfig
+	// RefreshTTL is the heartbeat TTL of registrations that do not set their
+	// own. RefreshInterval is how often registrations heartbeat and
+	// publishers refresh. Zero values use the defaults, set values must be at
+	// least a second since Consul's TTLs have a granularity of seconds.
+	RefreshTTL      time.Duration
+	RefreshInterval time.Duration
+	// DeregisterCriticalAfter is the DeregisterCriticalAfter of
+	// registrations that do not set their own. Zero leaves them registered
+	// however long they are critical.
+	DeregisterCriticalAfter time.Duration
+	// SnapshotDir is where publishers persist the last healthy instances of
+	// each service so that they can start from them while the registry is
+	// down. Empty disables snapshots.
+	SnapshotDir string
+}
+
+// TTL returns RefreshTTL, or DefaultRefreshTTL when it is not set.
+func (c Config) TTL() time.Duration {
+	if c.RefreshTTL > 0 {
+		return c.RefreshTTL
+	}
+	return DefaultRefreshTTL
+}
+
+// Interval returns RefreshInterval. When it is not set it returns
+// DefaultRefreshInterval, or half the TTL if the default is not shorter than
+// the TTL.
+func (c Config) Interval() time.Duration {
+	if c.RefreshInterval > 0 {
+		return c.RefreshInterval
+	}
+	if DefaultRefreshInterval < c.TTL() {
+		return DefaultRefreshInterval
+	}
+	return c.TTL() / 2
+}
+
+// Validate checks that heartbeats are sent more often than they expire.
+func (c Config) Validate() error {
+	if c.RefreshTTL < 0 || c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh ttl %s and interval %s must not be negative", c.RefreshTTL, c.RefreshInterval)
+	}
+	if (c.RefreshTTL > 0 && c.RefreshTTL < time.Second) || (c.RefreshInterval > 0 && c.RefreshInterval < time.Second) {
+		return fmt.Errorf("refresh ttl %s and interval %s must be at least a second", c.RefreshTTL, c.RefreshInterval)
+	}
+	if c.DeregisterCriticalAfter < 0 {
+		return fmt.Errorf("deregister critical after %s must not be negative", c.DeregisterCriticalAfter)
+	}
+	if c.Interval() >= c.TTL() {
+		return fmt.Errorf("refresh interval %s must be shorter than the refresh ttl %s", c.Interval(), c.TTL())
+	}
+	return nil
+}
+
+// TLSConfig configures https connections to the registry. CAFile is a PEM
+// bundle used in place of the system roots, CertFile and KeyFile are the
+// client certificate presented to the registry.
+type TLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.InsecureSkipVerify
 }
 
 type ConsulAdapter struct {
-	Offline   bool
-	client    *consul_api.Client
-	lastIndex uint64
-	status    *AdapterStatus
-	mtx       *sync.Mutex
+	Offline         bool
+	nodes           []*consulNode
+	current         int
+	registrations   map[string]ServiceRegistration
+	maintenance     map[string]string
+	ttl             time.Duration
+	deregisterAfter time.Duration
+	status          *AdapterStatus
+	mtx             *sync.Mutex
 }
 
 type ServiceRegistration struct {
@@ -34,17 +122,28 @@ type ServiceRegistration struct {
 	Id               string
 	Tags             []string
 	TTL              string
+	Checks           []Check
 	ConsulNodes      []string
 	AdvertiseAddr    string
 	SkipRegistration bool
+	// AdvertiseOptions selects the host address service.NewService fills
+	// AdvertiseAddr with when it is blank.
+	AdvertiseOptions platform.AddressOptions
+	// DeregisterCriticalAfter has the registry remove the service once its
+	// heartbeat has been critical for this long, so instances that were
+	// killed without deregistering do not linger. Consul reaps critical
+	// services every 30 seconds and no sooner than a minute.
+	DeregisterCriticalAfter string
 }
 
 type AdapterStatus struct {
-	status int
-}
-
-func (as *AdapterStatus) setStatus(i int) {
-	as.status = i
+	status         int
+	last           StatusChange
+	subscribers    map[int]StatusHandler
+	nextSubscriber int
+	pending        []statusDelivery
+	delivering     bool
+	queue          *sync.Mutex
 }
 
 func (as *AdapterStatus) String() string {
@@ -62,6 +161,55 @@ func (s *ServiceRegistration) String() string {
 	return fmt.Sprintf("name: %s address: %s port: %v", s.Name, s.Address, s.Port)
 }
 
+// checkHost is the host:port registry checks use to reach the service.
+func (s *ServiceRegistration) checkHost() string {
+	addr := s.AdvertiseAddr
+	if addr == "" {
+		addr = s.Address
+	}
+	if ip := net.ParseIP(addr); addr == "" || (ip != nil && ip.IsUnspecified()) {
+		addr = "127.0.0.1"
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(s.Port))
+}
+
+// checkURL resolves an HTTP check path against the service's own address.
+func (s *ServiceRegistration) checkURL(path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return s.Scheme() + "://" + s.checkHost() + path
+}
+
+// Tag of services serving https
+const TagHTTPS = "scheme=https"
+
+// Scheme returns https for services tagged with TagHTTPS, and http otherwise.
+func (s *ServiceRegistration) Scheme() string {
+	return schemeOf(s.Tags)
+}
+
+func schemeOf(tags []string) string {
+	for _, t := range tags {
+		if t == TagHTTPS {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// HeartbeatCheckID is the registry id of the TTL check the pulser keeps
+// passing. The registry only numbers check ids when there is more than one.
+func (s *ServiceRegistration) HeartbeatCheckID() string {
+	if len(s.Checks) == 0 {
+		return "service:" + s.Id
+	}
+	return "service:" + s.Id + ":1"
+}
+
 func (s *ServiceRegistration) Valid() bool {
 	if s.Name == "" {
 		return false
@@ -77,16 +225,172 @@ func (s *ServiceRegistration) Valid() bool {
 		return false
 	}
 
+	if !optionalDuration(s.DeregisterCriticalAfter) {
+		return false
+	}
+
+	for _, c := range s.Checks {
+		if !c.Valid() {
+			return false
+		}
+	}
+
 	return true
 }
 
-type VailService struct {
-	Name  string
-	Nodes []*Node
+const (
+	CheckTTL  = "ttl"
+	CheckHTTP = "http"
+	CheckTCP  = "tcp"
+)
+
+// Check declares a health check the registry runs against a registered
+// service in addition to the TTL heartbeat driven by the pulser.
+//
+// HTTP checks poll Path on the service's advertised address and port unless
+// Path is a full URL, over https when the service is tagged with TagHTTPS.
+// TLSSkipVerify has the registry accept any certificate. TCP checks dial
+// Address, defaulting to the service's advertised address and port. TTL
+// checks only take a TTL.
+type Check struct {
+	Type          string
+	Path          string
+	Address       string
+	Interval      string
+	Timeout       string
+	TTL           string
+	TLSSkipVerify bool
+}
+
+func HTTPCheck(path, interval, timeout string) Check {
+	return Check{Type: CheckHTTP, Path: path, Interval: interval, Timeout: timeout}
+}
+
+func TCPCheck(address, interval, timeout string) Check {
+	return Check{Type: CheckTCP, Address: address, Interval: interval, Timeout: timeout}
+}
+
+func TTLCheck(ttl string) Check {
+	return Check{Type: CheckTTL, TTL: ttl}
+}
+
+func (c Check) Valid() bool {
+	switch c.Type {
+	case CheckTTL:
+		return validDuration(c.TTL) && c.Interval == "" && c.Timeout == "" && c.Path == "" && c.Address == ""
+	case CheckHTTP:
+		return c.Path != "" && validDuration(c.Interval) && optionalDuration(c.Timeout)
+	case CheckTCP:
+		return validDuration(c.Interval) && optionalDuration(c.Timeout)
+	default:
+		return false
+	}
+}
+
+func (c Check) String() string {
+	switch c.Type {
+	case CheckTTL:
+		return fmt.Sprintf("ttl %s", c.TTL)
+	case CheckHTTP:
+		return fmt.Sprintf("http %s every %s", c.Path, c.Interval)
+	case CheckTCP:
+		return fmt.Sprintf("tcp %s every %s", c.Address, c.Interval)
+	default:
+		return "invalid check"
+	}
+}
+
+// ttlOr parses the registration's TTL, returning def when it is blank.
+func (s *ServiceRegistration) ttlOr(def time.Duration) (time.Duration, error) {
+	if s.TTL == "" {
+		return def, nil
+	}
+	ttl, err := time.ParseDuration(s.TTL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid registration ttl %s: %v", s.TTL, err)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid registration ttl %s: must be positive", s.TTL)
+	}
+	return ttl, nil
+}
+
+func validDuration(s string) bool {
+	d, err := time.ParseDuration(s)
+	return err == nil && d > 0
+}
+
+func optionalDuration(s string) bool {
+	return s == "" || validDuration(s)
+}
+
+// Instance is a single registered instance of a service as seen by the
+// registry catalog.
+type Instance struct {
+	ID          string
+	Name        string
+	Node        string
+	NodeAddress string
+	Address     string
+	Port        int
+	Tags        []string
+}
+
+// HostPort returns the address clients should use to reach the instance,
+// falling back to the node address when the service did not advertise one.
+func (i *Instance) HostPort() string {
+	addr := i.Address
+	if addr == "" {
+		addr = i.NodeAddress
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(i.Port))
+}
+
+// Scheme returns the scheme clients should use to reach the instance.
+func (i *Instance) Scheme() string {
+	return schemeOf(i.Tags)
+}
+
+// HasTag reports whether the instance was registered with tag.
+func (i *Instance) HasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	HealthPassing  = "passing"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+// HealthCheck is the latest result of a single check attached to an instance
+// or to the node it runs on.
+type HealthCheck struct {
+	ID        string
+	Name      string
+	Status    string
+	Output    string
+	ServiceID string
 }
 
-type Node struct {
-	*consul_api.CatalogService
+// HealthEntry is an instance together with the health checks that gate it.
+type HealthEntry struct {
+	Instance *Instance
+	Checks   []*HealthCheck
+}
+
+// Passing reports whether every check attached to the entry is passing.
+func (e *HealthEntry) Passing() bool {
+	for _, c := range e.Checks {
+		if c.Status != HealthPassing {
+			return false
+		}
+	}
+	return true
 }
 
 type RegistryAdapter interface {
@@ -94,12 +398,17 @@ type RegistryAdapter interface {
 	DeRegister(service ServiceRegistration) error
 	Sync(service ServiceRegistration) error
 
+	// RegisterExternal puts a service we do not run into discovery, and
+	// DeregisterExternal takes it out again.
+	RegisterExternal(service ExternalRegistration) error
+	DeregisterExternal(service ExternalRegistration) error
+
 	Ping() error
 	Status() int
 	Disconnected() bool
 	Type() string
 
-	FindService(name, tag string) ([]*consul_api.CatalogService, error)
+	FindService(name, tag string) ([]*Instance, error)
 	FindServices() (map[string][]string, error)
-	CheckService(name, tag string, passing bool) ([]*consul_api.ServiceEntry, error)
+	CheckService(name, tag string, passing bool) ([]*HealthEntry, error)
 }
@@ -0,0 +1,95 @@
+package registry_test
+
+import (
+	"time"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ServiceRegistration", func() {
+	var sr registry.ServiceRegistration
+
+	BeforeEach(func() {
+		sr = registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "2s"}
+	})
+
+	It("should accept well formed checks", func() {
+		sr.Checks = []registry.Check{
+			registry.HTTPCheck("/health", "10s", "1s"),
+			registry.TCPCheck("", "10s", ""),
+			registry.TTLCheck("30s"),
+		}
+		Expect(sr.Valid()).To(BeTrue())
+	})
+
+	It("should reject checks missing their type specific fields", func() {
+		for _, check := range []registry.Check{
+			registry.HTTPCheck("", "10s", "1s"),
+			registry.HTTPCheck("/health", "", "1s"),
+			registry.TCPCheck("", "10s", "soon"),
+			registry.TTLCheck(""),
+			registry.Check{Type: registry.CheckTTL, TTL: "30s", Interval: "10s"},
+			registry.Check{Type: registry.CheckTTL, TTL: "30s", Timeout: "1s"},
+			registry.Check{Type: registry.CheckTTL, TTL: "30s", Path: "/health"},
+			registry.Check{Type: "script", Interval: "10s"},
+			registry.Check{Type: "grpc", Interval: "10s"},
+		} {
+			sr.Checks = []registry.Check{check}
+			Expect(sr.Valid()).To(BeFalse(), check.String())
+		}
+	})
+
+	It("should use the https scheme when tagged with it", func() {
+		Expect(sr.Scheme()).To(Equal("http"))
+		sr.Tags = []string{"v1", registry.TagHTTPS}
+		Expect(sr.Scheme()).To(Equal("https"))
+
+		instance := &registry.Instance{Tags: sr.Tags}
+		Expect(instance.Scheme()).To(Equal("https"))
+	})
+})
+
+var _ = Describe("Config", func() {
+	It("should default the refresh TTL and interval", func() {
+		config := registry.Config{}
+		Expect(config.TTL()).To(Equal(registry.DefaultRefreshTTL))
+		Expect(config.Interval()).To(Equal(registry.DefaultRefreshInterval))
+		Expect(config.Validate()).To(Succeed())
+
+		config = registry.Config{RefreshTTL: time.Second}
+		Expect(config.Interval()).To(Equal(500 * time.Millisecond))
+		Expect(config.Validate()).To(Succeed())
+	})
+
+	It("should reject an interval that is not shorter than the TTL", func() {
+		config := registry.Config{AdapterURI: "memory://", RefreshTTL: 5 * time.Second, RefreshInterval: 5 * time.Second}
+		Expect(config.Validate()).ToNot(Succeed())
+
+		_, err := registry.NewBackend(config)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject a sub-second TTL or interval", func() {
+		Expect(registry.Config{RefreshTTL: 30}.Validate()).ToNot(Succeed())
+		Expect(registry.Config{RefreshTTL: 500 * time.Millisecond}.Validate()).ToNot(Succeed())
+		Expect(registry.Config{RefreshInterval: 10 * time.Millisecond}.Validate()).ToNot(Succeed())
+		Expect(registry.Config{RefreshTTL: 2 * time.Second, RefreshInterval: time.Second}.Validate()).To(Succeed())
+	})
+
+	It("should register services without a TTL with the refresh TTL", func() {
+		m, err := registry.NewBackend(registry.Config{AdapterURI: "memory://", RefreshTTL: time.Second})
+		Expect(err).ToNot(HaveOccurred())
+
+		sr := registry.ServiceRegistration{AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost"}
+		Expect(m.Register(sr)).To(Succeed())
+		Expect(m.Sync(sr)).To(Succeed())
+
+		Eventually(func() int {
+			entries, _ := m.CheckService("bifrost", "", true)
+			return len(entries)
+		}, 3*time.Second).Should(Equal(0))
+	})
+})
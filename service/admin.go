@@ -0,0 +1,186 @@
+package service
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.vailsys.com/vail-cloud-services/platform/discovery"
+)
+
+// Routes served by the admin router
+const (
+	defaultRoutesPath    = "/admin/routes"
+	defaultDiscoveryPath = "/admin/discovery"
+	defaultRegistryPath  = "/admin/registry"
+	defaultPulsePath     = "/admin/pulse"
+	defaultPprofPath     = "/debug/pprof/*profile"
+	defaultExpvarPath    = "/debug/vars"
+)
+
+// Route is a handler registered on the service's router.
+type Route struct {
+	Methods []string `json:"methods"`
+	Paths   []string `json:"paths"`
+}
+
+// ClientState is what a service client currently discovers.
+type ClientState struct {
+	Service   string   `json:"service"`
+	Count     int      `json:"count"`
+	Endpoints []string `json:"endpoints,omitempty"`
+	Stale     bool     `json:"stale"`
+}
+
+// RegistryState is the connection state of the service's registry adapter.
+type RegistryState struct {
+	Type      string    `json:"type"`
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// PulseState is the state of the heartbeat keeping the service registered.
+type PulseState struct {
+	Registered bool      `json:"registered"`
+	Active     bool      `json:"active"`
+	State      string    `json:"state,omitempty"`
+	LastBeat   time.Time `json:"last_beat"`
+	LastError  string    `json:"last_error,omitempty"`
+	Failures   int       `json:"failures"`
+}
+
+// Routes lists the handlers added to the service.
+func (service *Service) Routes() []Route {
+	routes := make([]Route, 0, len(service.ServiceHandlers))
+	for _, sh := range service.ServiceHandlers {
+		routes = append(routes, Route{Methods: sh.Methods, Paths: sh.Paths})
+	}
+	return routes
+}
+
+// DiscoveryState reports the endpoints of every service client.
+func (service *Service) DiscoveryState() []ClientState {
+	states := make([]ClientState, 0, len(service.ServiceClients))
+	for _, c := range service.ServiceClients {
+		state := ClientState{Service: c.ServiceName}
+		if c.Loadbalancer != nil {
+			state.Count = c.Loadbalancer.Count()
+		}
+		if lister, ok := c.Loadbalancer.(discovery.EndpointLister); ok {
+			for _, u := range lister.Endpoints() {
+				state.Endpoints = append(state.Endpoints, u.String())
+			}
+			state.Stale = lister.Stale()
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// RegistryState reports whether the registry adapter is connected and since
+// when.
+func (service *Service) RegistryState() RegistryState {
+	if service.RegistryAdapter == nil {
+		return RegistryState{}
+	}
+	change := service.RegistryStatus()
+	return RegistryState{
+		Type:      service.RegistryAdapter.Type(),
+		Connected: !service.RegistryAdapter.Disconnected(),
+		Since:     change.Time,
+		LastError: change.LastError,
+	}
+}
+
+// PulseState reports the heartbeat of the service's registration.
+func (service *Service) PulseState() PulseState {
+	service.mtx.Lock()
+	pulse := service.pulse
+	service.mtx.Unlock()
+
+	if pulse == nil {
+		return PulseState{}
+	}
+	status := pulse.Status()
+	return PulseState{
+		Registered: true,
+		Active:     pulse.Active(),
+		State:      status.State.String(),
+		LastBeat:   status.LastBeat,
+		LastError:  status.LastError,
+		Failures:   status.Failures,
+	}
+}
+
+// adminRoute mounts an operational route on the admin router. It is only
+// served when AdminAddr is set, and never on the service's own port.
+func (service *Service) adminRoute(method, path string, handler gin.HandlerFunc) {
+	service.Admin.Handle(method, path, handler)
+}
+
+func (service *Service) initAdmin() {
+	service.adminRoute("GET", defaultRoutesPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "routes": service.Routes()})
+	})
+	service.adminRoute("GET", defaultDiscoveryPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "clients": service.DiscoveryState()})
+	})
+	service.adminRoute("GET", defaultRegistryPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "registry": service.RegistryState()})
+	})
+	service.adminRoute("GET", defaultPulsePath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "pulse": service.PulseState()})
+	})
+
+	service.adminRoute("GET", defaultPprofPath, pprofHandler)
+	service.adminRoute("POST", defaultPprofPath, pprofHandler)
+	service.adminRoute("GET", defaultExpvarPath, gin.WrapH(expvar.Handler()))
+}
+
+func pprofHandler(c *gin.Context) {
+	switch c.Param("profile") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// startAdmin serves the admin router on AdminAddr.
+func (service *Service) startAdmin() error {
+	listener, err := net.Listen("tcp", service.AdminAddr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: service.Admin}
+	go srv.Serve(listener)
+
+	service.mtx.Lock()
+	service.adminSrv = srv
+	service.mtx.Unlock()
+
+	service.Logger.Infof("service %s admin listening on %s", service.Registration.Name, listener.Addr())
+	return nil
+}
+
+func (service *Service) stopAdmin() {
+	service.mtx.Lock()
+	srv := service.adminSrv
+	service.adminSrv = nil
+	service.mtx.Unlock()
+
+	if srv != nil {
+		srv.Close()
+	}
+}
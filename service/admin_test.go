@@ -0,0 +1,127 @@
+package service_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/discovery"
+	"gitlab.vailsys.com/vail-cloud-services/platform/discovery/static"
+	"gitlab.vailsys.com/vail-cloud-services/platform/heimdal"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Admin", func() {
+	var ser *service.Service
+	var cancel context.CancelFunc
+	var errs chan error
+
+	get := func(u string) (int, string) {
+		res, err := http.Get(u)
+		Expect(err).ToNot(HaveOccurred())
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return res.StatusCode, string(body)
+	}
+
+	admin := func(path string, v interface{}) {
+		code, body := get("http://127.0.0.1:13110" + path)
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal([]byte(body), v)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ser = service.NewService(registry.ServiceRegistration{
+			Address:       "127.0.0.1",
+			AdvertiseAddr: "127.0.0.1",
+			Port:          13109,
+			Id:            "administered1",
+			Name:          "administered",
+			TTL:           "5s",
+		})
+		ser.RegistryAdapter = registry.NewMemoryAdapter()
+		ser.AdminAddr = "127.0.0.1:13110"
+		ser.DrainDelay = time.Millisecond
+		ser.AddHandler(service.ServiceHandler{
+			Methods: []string{"GET"},
+			Paths:   []string{"/widgets"},
+			Handler: func(c *gin.Context) { c.String(http.StatusOK, "widgets") },
+		})
+
+		endpoints := []*url.URL{&url.URL{Scheme: "http", Host: "127.0.0.1:4000"}}
+		ser.AddServiceClient(heimdal.NewHttpServiceClient("upstream", discovery.RoundRobin(static.NewStaticPublisher(endpoints))))
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		errs = make(chan error, 1)
+		go func() {
+			errs <- ser.RunContext(ctx)
+		}()
+		Eventually(ser.Ready(), 5*time.Second).Should(BeClosed())
+	})
+
+	AfterEach(func() {
+		cancel()
+		Eventually(errs).Should(Receive())
+	})
+
+	It("should serve debug endpoints on the admin listener only", func() {
+		code, _ := get("http://127.0.0.1:13110/debug/pprof/")
+		Expect(code).To(Equal(http.StatusOK))
+		code, body := get("http://127.0.0.1:13110/debug/vars")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring("memstats"))
+
+		code, _ = get("http://127.0.0.1:13109/debug/pprof/")
+		Expect(code).To(Equal(http.StatusNotFound))
+		code, _ = get("http://127.0.0.1:13109/admin/jobs")
+		Expect(code).To(Equal(http.StatusNotFound))
+		code, _ = get("http://127.0.0.1:13110/admin/jobs")
+		Expect(code).To(Equal(http.StatusOK))
+	})
+
+	It("should never serve operational routes on the service's router", func() {
+		public := service.NewService(registry.ServiceRegistration{Name: "unadministered", SkipRegistration: true})
+		ts := httptest.NewServer(public.Router)
+		defer ts.Close()
+
+		for _, path := range []string{"/admin/routes", "/admin/jobs", "/admin/maintenance", "/admin/pulse", "/debug/vars"} {
+			code, _ := get(ts.URL + path)
+			Expect(code).To(Equal(http.StatusNotFound), path)
+		}
+	})
+
+	It("should report routes, discovery, registry and pulse state", func() {
+		var routes struct{ Routes []service.Route }
+		admin("/admin/routes", &routes)
+		Expect(routes.Routes).To(ContainElement(service.Route{Methods: []string{"GET"}, Paths: []string{"/widgets"}}))
+
+		var clients struct{ Clients []service.ClientState }
+		admin("/admin/discovery", &clients)
+		Expect(clients.Clients).To(Equal([]service.ClientState{
+			{Service: "upstream", Count: 1, Endpoints: []string{"http://127.0.0.1:4000"}},
+		}))
+
+		var reg struct{ Registry service.RegistryState }
+		admin("/admin/registry", &reg)
+		Expect(reg.Registry.Type).To(Equal("memory"))
+		Expect(reg.Registry.Connected).To(BeTrue())
+
+		Eventually(func() bool {
+			var pulse struct{ Pulse service.PulseState }
+			admin("/admin/pulse", &pulse)
+			return pulse.Pulse.Registered && pulse.Pulse.Active
+		}, 5*time.Second).Should(BeTrue())
+	})
+})
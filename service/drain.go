@@ -0,0 +1,83 @@
+package service
+
+import (
+	"errors"
+	"time"
+)
+
+// Upper bound for in-flight requests to complete once the server stopped
+// accepting connections
+const defaultDrainTimeout = 10 * time.Second
+
+var errDraining = errors.New("service is shutting down")
+
+// drainDelay returns DrainDelay, or the publisher refresh interval, which is
+// how long callers may keep routing to a deregistered instance.
+func (service *Service) drainDelay() time.Duration {
+	if service.DrainDelay > 0 {
+		return service.DrainDelay
+	}
+	return service.RegistryConfig.Interval()
+}
+
+func (service *Service) drainTimeout() time.Duration {
+	if service.DrainTimeout > 0 {
+		return service.DrainTimeout
+	}
+	return defaultDrainTimeout
+}
+
+// Draining reports whether the service is shutting down.
+func (service *Service) Draining() bool {
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+	return service.draining
+}
+
+// drain shuts the service down in order: it turns unready and deregisters,
+// waits for the deregistration to reach callers, stops accepting connections,
+// waits for in-flight requests, and then stops clients, jobs and locks.
+func (service *Service) drain() {
+	name := service.Registration.Name
+	start := time.Now()
+
+	service.mtx.Lock()
+	pulse := service.pulse
+	serving := service.serving
+	service.mtx.Unlock()
+
+	service.Logger.Infof("draining service %s", name)
+	service.unwatchRegistry()
+
+	if pulse != nil {
+		pulse.Stop()
+		service.Logger.Infof("service %s deregistered", name)
+
+		delay := service.drainDelay()
+		service.Logger.Infof("waiting %v for the deregistration of %s to propagate", delay, name)
+		time.Sleep(delay)
+	}
+
+	service.srv.Close()
+	service.Logger.Infof("service %s stopped accepting connections", name)
+
+	if serving {
+		timeout := service.drainTimeout()
+		select {
+		case <-service.served:
+			service.Logger.Infof("service %s finished its in-flight requests", name)
+		case <-time.After(timeout):
+			service.Logger.Warnf("service %s still had requests in flight after %v", name, timeout)
+		}
+	}
+
+	service.stopServiceClients()
+	service.Logger.Infof("service %s stopped its service clients", name)
+	service.stopJobs()
+	service.releaseLocks()
+	service.Logger.Infof("service %s stopped its jobs and released its locks", name)
+	service.stopTLS()
+	service.stopAdmin()
+
+	service.Logger.Infof("service %s drained in %v", name, time.Since(start))
+}
@@ -0,0 +1,128 @@
+package service_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+)
+
+var _ = Describe("Drain", func() {
+	var ser *service.Service
+	var adapter *registry.MemoryAdapter
+	var release chan struct{}
+
+	registered := func() bool {
+		_, err := adapter.FindService("drained", "")
+		return err == nil
+	}
+
+	BeforeEach(func() {
+		adapter = registry.NewMemoryAdapter()
+		release = make(chan struct{})
+
+		ser = service.NewService(registry.ServiceRegistration{
+			Address:       "127.0.0.1",
+			AdvertiseAddr: "127.0.0.1",
+			Port:          13105,
+			Id:            "drained1",
+			Name:          "drained",
+			TTL:           "5s",
+		})
+		ser.RegistryAdapter = adapter
+		ser.DrainDelay = 500 * time.Millisecond
+		// abandoned requests outlive the spec, so they must not read the
+		// next spec's channel
+		wait := release
+		ser.AddHandler(service.ServiceHandler{
+			Methods: []string{"GET"},
+			Paths:   []string{"/slow"},
+			Handler: func(c *gin.Context) {
+				<-wait
+				c.String(http.StatusOK, "done")
+			},
+		})
+
+		go func() {
+			ser.Run()
+		}()
+		Eventually(registered, 5*time.Second).Should(BeTrue())
+
+		// registration happens before the server listens
+		Eventually(func() int {
+			res, err := http.Get("http://127.0.0.1:13105/health/live")
+			if err != nil {
+				return 0
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}).Should(Equal(http.StatusOK))
+	})
+
+	It("should deregister, wait for the delay and finish in-flight requests", func() {
+		responses := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			res, err := http.Get("http://127.0.0.1:13105/slow")
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			responses <- res.StatusCode
+		}()
+
+		// let the request reach the handler
+		time.Sleep(100 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			ser.Stop()
+			close(stopped)
+		}()
+
+		Eventually(ser.Draining).Should(BeTrue())
+		Eventually(registered).Should(BeFalse())
+		Expect(ser.Readiness().Healthy()).To(BeFalse())
+
+		// still accepting connections until the delay is over
+		res, err := http.Get("http://127.0.0.1:13105/health/live")
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+
+		Consistently(stopped, time.Second).ShouldNot(BeClosed())
+		close(release)
+
+		Eventually(responses).Should(Receive(Equal(http.StatusOK)))
+		Eventually(stopped).Should(BeClosed())
+
+		_, err = http.Get("http://127.0.0.1:13105/health/live")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should give up on in-flight requests after the drain timeout", func() {
+		ser.DrainTimeout = 200 * time.Millisecond
+		defer close(release)
+
+		go http.Get("http://127.0.0.1:13105/slow")
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		ser.Stop()
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+
+		// stopping again only waits for the first call
+		ser.Stop()
+	})
+
+	It("should refuse to run again while running or once stopped", func() {
+		defer close(release)
+
+		Expect(ser.Run()).To(Equal(service.ErrAlreadyRun))
+
+		ser.Stop()
+		Expect(ser.Run()).To(Equal(service.ErrAlreadyRun))
+	})
+})
@@ -0,0 +1,128 @@
+package service_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/middleware"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+)
+
+type traceMiddleware string
+
+func (t traceMiddleware) GinFunc() gin.HandlerFunc {
+	return trace(string(t))
+}
+
+func trace(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get("trace")
+		steps, _ := value.([]string)
+		c.Set("trace", append(steps, name))
+	}
+}
+
+func traced(c *gin.Context) {
+	value, _ := c.Get("trace")
+	steps, _ := value.([]string)
+	c.String(http.StatusOK, strings.Join(append(steps, "handler"), ","))
+}
+
+var _ = Describe("Handlers", func() {
+	var ser *service.Service
+	var ts *httptest.Server
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(ts.URL + path)
+		Expect(err).ToNot(HaveOccurred())
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return res.StatusCode, string(body)
+	}
+
+	BeforeEach(func() {
+		ser = service.NewService(registry.ServiceRegistration{Name: "routed", SkipRegistration: true})
+		ts = httptest.NewServer(ser.Router)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("should run the handler's middleware in the order declared", func() {
+		Expect(ser.AddHandler(service.ServiceHandler{
+			Methods:     []string{"GET"},
+			Paths:       []string{"/traced"},
+			Handler:     traced,
+			Middlewares: []gin.HandlerFunc{trace("first"), trace("second")},
+		}, traceMiddleware("third"))).To(Succeed())
+
+		code, body := get("/traced")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("first,second,third,handler"))
+	})
+
+	It("should let route middleware reject requests", func() {
+		auth := middleware.BasicAuthFunc(func(user, password string, c *gin.Context) bool {
+			return user == "admin" && password == "secret"
+		})
+		Expect(ser.AddHandler(service.ServiceHandler{
+			Methods: []string{"GET"},
+			Paths:   []string{"/private"},
+			Handler: traced,
+		}, auth)).To(Succeed())
+		Expect(ser.AddHandler(service.ServiceHandler{
+			Methods: []string{"GET"},
+			Paths:   []string{"/public"},
+			Handler: traced,
+		})).To(Succeed())
+
+		code, _ := get("/private")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+		code, _ = get("/public")
+		Expect(code).To(Equal(http.StatusOK))
+
+		req, _ := http.NewRequest("GET", ts.URL+"/private", nil)
+		req.SetBasicAuth("admin", "secret")
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should run group middleware before route middleware", func() {
+		Expect(ser.AddGroupMiddleware("/v1", traceMiddleware("group"))).To(Succeed())
+		Expect(ser.AddGroupedHandler("/v1", service.ServiceHandler{
+			Methods:     []string{"GET"},
+			Paths:       []string{"/traced"},
+			Handler:     traced,
+			Middlewares: []gin.HandlerFunc{trace("route")},
+		})).To(Succeed())
+		Expect(ser.AddGroupedHandler("/v2", service.ServiceHandler{
+			Methods: []string{"GET"},
+			Paths:   []string{"/traced"},
+			Handler: traced,
+		})).To(Succeed())
+
+		_, body := get("/v1/traced")
+		Expect(body).To(Equal("group,route,handler"))
+		_, body = get("/v2/traced")
+		Expect(body).To(Equal("handler"))
+	})
+
+	It("should reject invalid middleware", func() {
+		sh := service.ServiceHandler{Methods: []string{"GET"}, Paths: []string{"/invalid"}, Handler: traced}
+		Expect(ser.AddHandler(sh, nil)).To(Equal(service.ErrInvalidMiddleware))
+
+		sh.Middlewares = []gin.HandlerFunc{nil}
+		Expect(ser.AddHandler(sh)).To(Equal(service.ErrInvalidMiddleware))
+	})
+})
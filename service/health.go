@@ -0,0 +1,227 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.vailsys.com/vail-cloud-services/platform/discovery"
+)
+
+const (
+	// Default routes reporting whether the process is alive and whether it
+	// should receive traffic
+	defaultLivenessPath  = "/health/live"
+	defaultReadinessPath = "/health/ready"
+
+	// Query restricting readiness to the instance's own checks, which is what
+	// the registry polls
+	localReadinessQuery = "local=true"
+
+	// How long a readiness check may take before it counts as failed
+	defaultReadinessCheckTimeout = 2 * time.Second
+
+	HealthPass = "pass"
+	HealthFail = "fail"
+)
+
+var (
+	ErrInvalidHealthCheck   = errors.New("invalid health check")
+	ErrDuplicateHealthCheck = errors.New("health check already exists")
+)
+
+// HealthCheckFunc reports why the service cannot serve requests, or nil when
+// it can.
+type HealthCheckFunc func() error
+
+// HealthCheckResult is the outcome of a single check.
+type HealthCheckResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HealthReport is the JSON body of the health endpoints.
+type HealthReport struct {
+	Status string              `json:"status"`
+	Checks []HealthCheckResult `json:"checks"`
+}
+
+// Healthy reports whether every check passed.
+func (r HealthReport) Healthy() bool {
+	return r.Status == HealthPass
+}
+
+type healthCheck struct {
+	name string
+	fn   HealthCheckFunc
+}
+
+// AddHealthCheck adds a check to the service's readiness. The service is
+// only ready while every check returns nil.
+func (service *Service) AddHealthCheck(name string, fn HealthCheckFunc) error {
+	if name == "" || fn == nil {
+		return ErrInvalidHealthCheck
+	}
+
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+
+	for _, c := range service.healthChecks {
+		if c.name == name {
+			return ErrDuplicateHealthCheck
+		}
+	}
+	service.healthChecks = append(service.healthChecks, healthCheck{name: name, fn: fn})
+	return nil
+}
+
+// Liveness reports that the process is up and serving. It runs no checks, so
+// that a failing dependency never gets a live instance restarted.
+func (service *Service) Liveness() HealthReport {
+	return HealthReport{Status: HealthPass, Checks: []HealthCheckResult{}}
+}
+
+// Readiness runs the registry check, a check per service client that its
+// load balancer has endpoints, and every check added with AddHealthCheck. A
+// draining service is never ready.
+func (service *Service) Readiness() HealthReport {
+	return service.readiness(true)
+}
+
+// LocalReadiness leaves the registry and service client checks out of
+// Readiness. The registry polls it: a dependency being down must not take its
+// callers out of discovery, nor keep services calling each other from ever
+// passing their checks.
+func (service *Service) LocalReadiness() HealthReport {
+	return service.readiness(false)
+}
+
+func (service *Service) readiness(dependencies bool) HealthReport {
+	service.mtx.Lock()
+	checks := make([]healthCheck, 0, len(service.healthChecks)+len(service.ServiceClients)+2)
+	if service.draining {
+		checks = append(checks, healthCheck{name: "shutdown", fn: func() error { return errDraining }})
+	}
+	if dependencies {
+		if service.RegistryAdapter != nil {
+			checks = append(checks, healthCheck{name: "registry", fn: service.checkRegistry})
+		}
+		for _, c := range service.ServiceClients {
+			checks = append(checks, healthCheck{name: "client:" + c.ServiceName, fn: checkEndpoints(c.Loadbalancer)})
+		}
+	}
+	checks = append(checks, service.healthChecks...)
+	service.mtx.Unlock()
+
+	return runHealthChecks(checks)
+}
+
+func (o Options) livenessPath() string {
+	if o.LivenessPath != "" {
+		return o.LivenessPath
+	}
+	return defaultLivenessPath
+}
+
+func (o Options) readinessPath() string {
+	if o.ReadinessPath != "" {
+		return o.ReadinessPath
+	}
+	return defaultReadinessPath
+}
+
+func (service *Service) initHealthEndpoints(livenessPath, readinessPath string) {
+	service.Router.GET(livenessPath, func(c *gin.Context) {
+		writeHealthReport(c, service.Liveness())
+	})
+	service.Router.GET(readinessPath, func(c *gin.Context) {
+		if c.Request.URL.RawQuery == localReadinessQuery {
+			writeHealthReport(c, service.LocalReadiness())
+			return
+		}
+		writeHealthReport(c, service.Readiness())
+	})
+}
+
+func writeHealthReport(c *gin.Context, report HealthReport) {
+	code := http.StatusOK
+	if !report.Healthy() {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, report)
+}
+
+func (service *Service) checkRegistry() error {
+	if !service.RegistryAdapter.Disconnected() {
+		return nil
+	}
+	status := service.RegistryStatus()
+	if status.LastError != "" {
+		return fmt.Errorf("registry %s is not connected: %s", service.RegistryAdapter.Type(), status.LastError)
+	}
+	return fmt.Errorf("registry %s is not connected", service.RegistryAdapter.Type())
+}
+
+func checkEndpoints(lb discovery.LoadBalancer) HealthCheckFunc {
+	return func() error {
+		if lb == nil || lb.Count() == 0 {
+			return discovery.ErrNoEndpointsAvailable
+		}
+		return nil
+	}
+}
+
+// runHealthChecks runs checks concurrently. A check that has not returned
+// within defaultReadinessCheckTimeout fails.
+func runHealthChecks(checks []healthCheck) HealthReport {
+	report := HealthReport{Status: HealthPass, Checks: make([]HealthCheckResult, len(checks))}
+
+	done := make(chan struct{}, len(checks))
+	for i, check := range checks {
+		go func(i int, check healthCheck) {
+			report.Checks[i] = runHealthCheck(check)
+			done <- struct{}{}
+		}(i, check)
+	}
+	for range checks {
+		<-done
+	}
+
+	for _, result := range report.Checks {
+		if result.Status != HealthPass {
+			report.Status = HealthFail
+		}
+	}
+	return report
+}
+
+func runHealthCheck(check healthCheck) HealthCheckResult {
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errs <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		errs <- check.fn()
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-time.After(defaultReadinessCheckTimeout):
+		err = fmt.Errorf("timed out after %v", defaultReadinessCheckTimeout)
+	}
+
+	result := HealthCheckResult{Name: check.name, Status: HealthPass, Latency: time.Since(start).String()}
+	if err != nil {
+		result.Status = HealthFail
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,147 @@
+package service_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/heimdal"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+)
+
+type countingBalancer struct {
+	count int
+}
+
+func (b *countingBalancer) Count() int             { return b.count }
+func (b *countingBalancer) Get() (*url.URL, error) { return nil, nil }
+func (b *countingBalancer) Stop()                  {}
+
+var _ = Describe("Health", func() {
+	var ser *service.Service
+	var ts *httptest.Server
+
+	get := func(path string) (int, service.HealthReport) {
+		res, err := http.Get(ts.URL + path)
+		Expect(err).ToNot(HaveOccurred())
+		defer res.Body.Close()
+
+		var report service.HealthReport
+		Expect(json.NewDecoder(res.Body).Decode(&report)).To(Succeed())
+		return res.StatusCode, report
+	}
+
+	BeforeEach(func() {
+		ser = service.NewService(registry.ServiceRegistration{
+			Address: "127.0.0.1",
+			Port:    13104,
+			Id:      "checked1",
+			Name:    "checked",
+		})
+		ser.RegistryAdapter = registry.NewMemoryAdapter()
+		ts = httptest.NewServer(ser.Router)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("should always be live", func() {
+		Expect(ser.AddHealthCheck("broken", func() error { return errors.New("broken") })).To(Succeed())
+
+		code, report := get("/health/live")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(report.Status).To(Equal(service.HealthPass))
+	})
+
+	It("should be checked by the registry on its local readiness", func() {
+		Expect(ser.Registration.Checks).To(ContainElement(registry.HTTPCheck("/health/ready?local=true", "10s", "2s")))
+
+		ser.AddServiceClient(heimdal.NewHttpServiceClient("upstream", &countingBalancer{}))
+		code, _ := get("/health/ready")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		code, report := get("/health/ready?local=true")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(report.Checks).To(BeEmpty())
+
+		ser.Stop()
+		code, _ = get("/health/ready?local=true")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should be ready when the registry and every check pass", func() {
+		Expect(ser.AddHealthCheck("db", func() error { return nil })).To(Succeed())
+
+		code, report := get("/health/ready")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(report.Status).To(Equal(service.HealthPass))
+		Expect(report.Checks).To(HaveLen(2))
+		Expect(report.Checks[0].Name).To(Equal("registry"))
+		Expect(report.Checks[1].Name).To(Equal("db"))
+		Expect(report.Checks[1].Latency).ToNot(BeEmpty())
+	})
+
+	It("should not be ready when a check fails", func() {
+		Expect(ser.AddHealthCheck("db", func() error { return errors.New("db is down") })).To(Succeed())
+
+		code, report := get("/health/ready")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(report.Status).To(Equal(service.HealthFail))
+		Expect(report.Checks[1].Status).To(Equal(service.HealthFail))
+		Expect(report.Checks[1].Error).To(Equal("db is down"))
+	})
+
+	It("should not be ready while a service client has no endpoints", func() {
+		lb := &countingBalancer{}
+		ser.AddServiceClient(heimdal.NewHttpServiceClient("upstream", lb))
+
+		report := ser.Readiness()
+		Expect(report.Healthy()).To(BeFalse())
+		Expect(report.Checks[1].Name).To(Equal("client:upstream"))
+
+		lb.count = 2
+		Expect(ser.Readiness().Healthy()).To(BeTrue())
+	})
+
+	It("should reject invalid and duplicate checks", func() {
+		Expect(ser.AddHealthCheck("", func() error { return nil })).To(Equal(service.ErrInvalidHealthCheck))
+		Expect(ser.AddHealthCheck("db", nil)).To(Equal(service.ErrInvalidHealthCheck))
+		Expect(ser.AddHealthCheck("db", func() error { return nil })).To(Succeed())
+		Expect(ser.AddHealthCheck("db", func() error { return nil })).To(Equal(service.ErrDuplicateHealthCheck))
+	})
+
+	It("should mount the health endpoints where the options say", func() {
+		registration := registry.ServiceRegistration{Address: "127.0.0.1", Port: 13104, Id: "checked1", Name: "checked"}
+		moved, err := service.NewServiceWithOptions(registration, service.Options{
+			Registry:      registry.Config{AdapterURI: "memory://"},
+			LivenessPath:  "/_/live",
+			ReadinessPath: "/_/ready",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved.Registration.Checks).To(ContainElement(registry.HTTPCheck("/_/ready?local=true", "10s", "2s")))
+
+		ok := func(c *gin.Context) { c.String(http.StatusOK, "mine") }
+		Expect(moved.AddHandler(service.ServiceHandler{Methods: []string{"GET"}, Paths: []string{"/health/live", "/health/ready"}, Handler: ok})).To(Succeed())
+
+		ts.Close()
+		ts = httptest.NewServer(moved.Router)
+		code, report := get("/_/ready")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(report.Healthy()).To(BeTrue())
+
+		skipped, err := service.NewServiceWithOptions(registration, service.Options{
+			Registry:            registry.Config{AdapterURI: "memory://"},
+			SkipHealthEndpoints: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(skipped.Registration.Checks).To(BeEmpty())
+		Expect(skipped.AddHandler(service.ServiceHandler{Methods: []string{"GET"}, Paths: []string{"/*path"}, Handler: ok})).To(Succeed())
+	})
+})
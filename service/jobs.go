@@ -0,0 +1,325 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+)
+
+const (
+	// Route listing the background jobs and their last run
+	defaultJobsPath = "/admin/jobs"
+
+	// Upper bound for the delay before restarting a worker that returned
+	defaultWorkerMaxBackoff = 1 * time.Minute
+)
+
+var (
+	ErrInvalidJob   = errors.New("invalid job")
+	ErrDuplicateJob = errors.New("job already exists")
+)
+
+// JobFunc is the body of a background job. stop is closed when the job has to
+// end, either because the service is stopping or because a singleton job
+// lost its lock, and the function should return promptly once it is.
+type JobFunc func(stop <-chan struct{}) error
+
+// Job is background work run alongside the service's HTTP server.
+type Job struct {
+	Name string
+	// Schedule runs the job on a cron expression, a descriptor such as
+	// @hourly, or "@every 30s". A job without a schedule is a worker: it is
+	// started with the service and restarted with a backoff if it returns
+	// before the service stops.
+	Schedule string
+	// Singleton jobs only run on the one instance of the service holding
+	// the job's registry lock.
+	Singleton bool
+	Run       JobFunc
+}
+
+// JobStatus is a snapshot of a job for the admin endpoint.
+type JobStatus struct {
+	Name      string    `json:"name"`
+	Schedule  string    `json:"schedule,omitempty"`
+	Singleton bool      `json:"singleton"`
+	Active    bool      `json:"active"`
+	Running   bool      `json:"running"`
+	Runs      int       `json:"runs"`
+	Failures  int       `json:"failures"`
+	LastStart time.Time `json:"last_start"`
+	LastEnd   time.Time `json:"last_end"`
+	LastError string    `json:"last_error,omitempty"`
+	NextRun   time.Time `json:"next_run"`
+}
+
+type jobRunner struct {
+	job      Job
+	schedule schedule
+	elector  *registry.LeaderElector
+	status   JobStatus
+	quit     chan struct{}
+	done     chan struct{}
+	mtx      *sync.Mutex
+}
+
+// AddJob registers a background job. Jobs start when the service runs, or
+// right away if it is already running, and stop when it stops.
+func (service *Service) AddJob(job Job) error {
+	if job.Name == "" || job.Run == nil {
+		return ErrInvalidJob
+	}
+
+	var sched schedule
+	if job.Schedule != "" {
+		var err error
+		sched, err = parseSchedule(job.Schedule)
+		if err != nil {
+			return err
+		}
+	}
+
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+
+	for _, j := range service.jobs {
+		if j.job.Name == job.Name {
+			return ErrDuplicateJob
+		}
+	}
+
+	runner := &jobRunner{
+		job:      job,
+		schedule: sched,
+		status:   JobStatus{Name: job.Name, Schedule: job.Schedule, Singleton: job.Singleton},
+		mtx:      &sync.Mutex{},
+	}
+
+	if job.Singleton {
+		key := fmt.Sprintf("service/%s/jobs/%s", service.Registration.Name, job.Name)
+		elector, err := registry.NewLeaderElector(service.RegistryAdapter, key, registry.LockOptions{SessionName: job.Name})
+		if err != nil {
+			return err
+		}
+		runner.elector = elector
+	}
+
+	service.jobs = append(service.jobs, runner)
+	if service.jobsStarted {
+		runner.start()
+	}
+	return nil
+}
+
+// Jobs returns the status of every registered job.
+func (service *Service) Jobs() []JobStatus {
+	service.mtx.Lock()
+	jobs := service.jobs
+	service.mtx.Unlock()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.Status())
+	}
+	return statuses
+}
+
+func (service *Service) initJobs() {
+	service.adminRoute("GET", defaultJobsPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "jobs": service.Jobs()})
+	})
+}
+
+func (service *Service) startJobs() {
+	service.mtx.Lock()
+	jobs := service.jobs
+	service.jobsStarted = true
+	service.mtx.Unlock()
+
+	for _, j := range jobs {
+		j.start()
+	}
+}
+
+func (service *Service) stopJobs() {
+	service.mtx.Lock()
+	jobs := service.jobs
+	service.jobsStarted = false
+	service.mtx.Unlock()
+
+	for _, j := range jobs {
+		j.stop()
+	}
+}
+
+func (j *jobRunner) Status() JobStatus {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.status
+}
+
+func (j *jobRunner) start() {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.quit != nil {
+		return
+	}
+	j.quit = make(chan struct{})
+	j.done = make(chan struct{})
+
+	platform.Logger.Infof("starting job %s", j.job.Name)
+
+	if j.elector == nil {
+		go func(quit, done chan struct{}) {
+			defer close(done)
+			j.loop(quit)
+		}(j.quit, j.done)
+		return
+	}
+
+	close(j.done)
+	j.elector.Start(func(lost <-chan struct{}) {
+		platform.Logger.Infof("job %s holds its lock", j.job.Name)
+		j.loop(lost)
+	})
+}
+
+// stop ends the job and waits for a running invocation to return.
+func (j *jobRunner) stop() {
+	j.mtx.Lock()
+	quit, done := j.quit, j.done
+	j.quit, j.done = nil, nil
+	j.mtx.Unlock()
+
+	if quit == nil {
+		return
+	}
+
+	platform.Logger.Infof("stopping job %s", j.job.Name)
+
+	close(quit)
+	if j.elector != nil {
+		j.elector.Stop()
+	}
+	<-done
+}
+
+// loop runs the job until stop is closed: on its schedule, or continuously
+// for a worker.
+func (j *jobRunner) loop(stop <-chan struct{}) {
+	j.setActive(true)
+	defer j.setActive(false)
+
+	if j.schedule == nil {
+		j.work(stop)
+		return
+	}
+
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			platform.Logger.Infof("job %s has no further runs", j.job.Name)
+			return
+		}
+		j.setNextRun(next)
+
+		select {
+		case <-time.After(next.Sub(time.Now())):
+			j.run(stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// work keeps a worker running, restarting it with a backoff whenever it
+// returns before stop is closed.
+func (j *jobRunner) work(stop <-chan struct{}) {
+	var backoff time.Duration
+
+	for {
+		err := j.run(stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err == nil {
+			backoff = 0
+		}
+		if backoff == 0 {
+			backoff = time.Second
+		} else {
+			backoff *= 2
+		}
+		if backoff > defaultWorkerMaxBackoff {
+			backoff = defaultWorkerMaxBackoff
+		}
+		platform.Logger.Infof("restarting worker %s in %v", j.job.Name, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// run calls the job once, turning a panic into an error.
+func (j *jobRunner) run(stop <-chan struct{}) (err error) {
+	j.mtx.Lock()
+	j.status.Running = true
+	j.status.LastStart = time.Now()
+	j.mtx.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			platform.Logger.Errorf("job %s panicked: %v\n%s", j.job.Name, r, buf)
+			err = fmt.Errorf("panic: %v", r)
+		}
+
+		j.mtx.Lock()
+		defer j.mtx.Unlock()
+		j.status.Running = false
+		j.status.LastEnd = time.Now()
+		j.status.Runs++
+		j.status.LastError = ""
+		if err != nil {
+			j.status.Failures++
+			j.status.LastError = err.Error()
+		}
+	}()
+
+	err = j.job.Run(stop)
+	if err != nil {
+		platform.Logger.Infof("job %s failed: %s", j.job.Name, err)
+	}
+	return err
+}
+
+func (j *jobRunner) setActive(val bool) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.status.Active = val
+	if !val {
+		j.status.NextRun = time.Time{}
+	}
+}
+
+func (j *jobRunner) setNextRun(t time.Time) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.status.NextRun = t
+}
@@ -0,0 +1,176 @@
+package service_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+)
+
+var _ = Describe("Jobs", func() {
+	var ser *service.Service
+	var adapter *registry.MemoryAdapter
+
+	newService := func(port int) *service.Service {
+		s := service.NewService(registry.ServiceRegistration{
+			Address:          "127.0.0.1",
+			Port:             port,
+			Id:               "jobs1",
+			Name:             "jobs",
+			TTL:              "5s",
+			SkipRegistration: true,
+		})
+		s.RegistryAdapter = adapter
+		return s
+	}
+
+	BeforeEach(func() {
+		adapter = registry.NewMemoryAdapter()
+		ser = newService(13101)
+	})
+
+	It("should reject invalid jobs", func() {
+		noop := func(stop <-chan struct{}) error { return nil }
+
+		Expect(ser.AddJob(service.Job{Name: "noop"})).To(Equal(service.ErrInvalidJob))
+		Expect(ser.AddJob(service.Job{Name: "noop", Schedule: "* * *", Run: noop})).ToNot(Succeed())
+		Expect(ser.AddJob(service.Job{Name: "noop", Schedule: "61 * * * *", Run: noop})).ToNot(Succeed())
+		Expect(ser.AddJob(service.Job{Name: "noop", Schedule: "@every nope", Run: noop})).ToNot(Succeed())
+
+		Expect(ser.AddJob(service.Job{Name: "noop", Schedule: "*/15 9-17 * * 1-5", Run: noop})).To(Succeed())
+		Expect(ser.AddJob(service.Job{Name: "noop", Run: noop})).To(Equal(service.ErrDuplicateJob))
+	})
+
+	It("should run scheduled jobs and workers while the service runs", func() {
+		var ticks, panics int32
+		started := make(chan struct{}, 1)
+
+		Expect(ser.AddJob(service.Job{Name: "tick", Schedule: "@every 50ms", Run: func(stop <-chan struct{}) error {
+			atomic.AddInt32(&ticks, 1)
+			return nil
+		}})).To(Succeed())
+		Expect(ser.AddJob(service.Job{Name: "yearly", Schedule: "@yearly", Run: func(stop <-chan struct{}) error {
+			return nil
+		}})).To(Succeed())
+		Expect(ser.AddJob(service.Job{Name: "panics", Schedule: "@every 50ms", Run: func(stop <-chan struct{}) error {
+			atomic.AddInt32(&panics, 1)
+			panic("boom")
+		}})).To(Succeed())
+		Expect(ser.AddJob(service.Job{Name: "worker", Run: func(stop <-chan struct{}) error {
+			started <- struct{}{}
+			<-stop
+			return nil
+		}})).To(Succeed())
+
+		go func() {
+			ser.Run()
+		}()
+
+		Eventually(started).Should(Receive())
+		Eventually(func() int32 { return atomic.LoadInt32(&ticks) }).Should(BeNumerically(">=", 2))
+		Eventually(func() int32 { return atomic.LoadInt32(&panics) }).Should(BeNumerically(">=", 1))
+
+		statuses := map[string]service.JobStatus{}
+		for _, s := range ser.Jobs() {
+			statuses[s.Name] = s
+		}
+		Expect(statuses["worker"].Running).To(BeTrue())
+		Expect(statuses["panics"].LastError).To(Equal("panic: boom"))
+
+		now := time.Now()
+		Expect(statuses["yearly"].NextRun).To(Equal(time.Date(now.Year()+1, 1, 1, 0, 0, 0, 0, now.Location())))
+
+		ts := httptest.NewServer(ser.Admin)
+		defer ts.Close()
+		res, err := http.Get(ts.URL + "/admin/jobs")
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		ser.Stop()
+
+		for _, s := range ser.Jobs() {
+			Expect(s.Active).To(BeFalse())
+			Expect(s.Running).To(BeFalse())
+		}
+
+		stopped := atomic.LoadInt32(&ticks)
+		Consistently(func() int32 { return atomic.LoadInt32(&ticks) }, 200*time.Millisecond).Should(Equal(stopped))
+	})
+
+	It("should match both day fields when the day of month starts with *", func() {
+		noop := func(stop <-chan struct{}) error { return nil }
+		Expect(ser.AddJob(service.Job{Name: "mondays", Schedule: "0 0 */2 * 1", Run: noop})).To(Succeed())
+
+		go func() {
+			ser.Run()
+		}()
+		defer ser.Stop()
+
+		// like cron, */2 restricts the days to odd ones rather than matching
+		// every odd day alongside every monday
+		now := time.Now()
+		monday := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		for monday.Weekday() != time.Monday || monday.Day()%2 == 0 {
+			monday = monday.AddDate(0, 0, 1)
+		}
+
+		Eventually(func() time.Time {
+			return ser.Jobs()[0].NextRun
+		}).Should(Equal(monday))
+	})
+
+	It("should restart workers that return early", func() {
+		var runs int32
+		Expect(ser.AddJob(service.Job{Name: "flaky", Run: func(stop <-chan struct{}) error {
+			atomic.AddInt32(&runs, 1)
+			return errors.New("flaked")
+		}})).To(Succeed())
+
+		go func() {
+			ser.Run()
+		}()
+		defer ser.Stop()
+
+		Eventually(func() int32 { return atomic.LoadInt32(&runs) }, 3*time.Second).Should(BeNumerically(">=", 2))
+		Expect(ser.Jobs()[0].Failures).To(BeNumerically(">=", 1))
+	})
+
+	It("should only run singleton jobs on the instance holding the lock", func() {
+		other := newService(13102)
+
+		var running int32
+		job := func(name string) service.Job {
+			return service.Job{Name: "reconcile", Singleton: true, Run: func(stop <-chan struct{}) error {
+				Expect(atomic.AddInt32(&running, 1)).To(Equal(int32(1)))
+				<-stop
+				atomic.AddInt32(&running, -1)
+				return nil
+			}}
+		}
+		Expect(ser.AddJob(job("a"))).To(Succeed())
+		Expect(other.AddJob(job("b"))).To(Succeed())
+
+		go func() {
+			ser.Run()
+		}()
+		go func() {
+			other.Run()
+		}()
+
+		Eventually(func() int32 { return atomic.LoadInt32(&running) }).Should(Equal(int32(1)))
+		Consistently(func() int32 { return atomic.LoadInt32(&running) }, 300*time.Millisecond).Should(Equal(int32(1)))
+
+		ser.Stop()
+		Eventually(func() bool { return other.Jobs()[0].Running }, 10*time.Second).Should(BeTrue())
+		other.Stop()
+		Expect(atomic.LoadInt32(&running)).To(Equal(int32(0)))
+	})
+})
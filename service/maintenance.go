@@ -0,0 +1,139 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+)
+
+// Admin route reporting, entering and leaving maintenance mode
+const defaultMaintenancePath = "/admin/maintenance"
+
+// Reason given to the registry when none is supplied
+const defaultMaintenanceReason = "maintenance"
+
+var ErrNotRegistered = errors.New("service is not registered")
+
+// MaintenanceStatus is the maintenance state reported by the admin endpoint.
+type MaintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// EnterMaintenance takes the service out of discovery without deregistering
+// it: it keeps heartbeating and serving requests, but clients stop picking it
+// until ExitMaintenance is called.
+func (service *Service) EnterMaintenance(reason string) error {
+	maintenance, err := service.maintenanceAdapter()
+	if err != nil {
+		return err
+	}
+	if reason == "" {
+		reason = defaultMaintenanceReason
+	}
+
+	err = maintenance.EnableMaintenance(service.Registration, reason)
+	if err != nil {
+		return err
+	}
+
+	service.mtx.Lock()
+	service.maintenance = &MaintenanceStatus{Enabled: true, Reason: reason}
+	service.mtx.Unlock()
+
+	service.Logger.Infof("service %s entered maintenance: %s", service.Registration.Name, reason)
+	return nil
+}
+
+// ExitMaintenance puts the service back into discovery.
+func (service *Service) ExitMaintenance() error {
+	maintenance, err := service.maintenanceAdapter()
+	if err != nil {
+		return err
+	}
+
+	err = maintenance.DisableMaintenance(service.Registration)
+	if err != nil {
+		return err
+	}
+
+	service.mtx.Lock()
+	service.maintenance = nil
+	service.mtx.Unlock()
+
+	service.Logger.Infof("service %s left maintenance", service.Registration.Name)
+	return nil
+}
+
+// Maintenance reports whether the service is in maintenance and why.
+func (service *Service) Maintenance() MaintenanceStatus {
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+
+	if service.maintenance == nil {
+		return MaintenanceStatus{}
+	}
+	return *service.maintenance
+}
+
+// toggleMaintenance flips maintenance mode, as done on SIGUSR1.
+func (service *Service) toggleMaintenance() {
+	var err error
+	if service.Maintenance().Enabled {
+		err = service.ExitMaintenance()
+	} else {
+		err = service.EnterMaintenance("")
+	}
+	if err != nil {
+		service.Logger.Warnf("unable to toggle maintenance for %s: %s", service.Registration.Name, err)
+	}
+}
+
+func (service *Service) maintenanceAdapter() (registry.Maintenance, error) {
+	if service.Registration.SkipRegistration {
+		return nil, ErrNotRegistered
+	}
+	maintenance, ok := service.RegistryAdapter.(registry.Maintenance)
+	if !ok {
+		return nil, registry.ErrMaintenanceNotSupported
+	}
+	return maintenance, nil
+}
+
+// initMaintenance mounts the maintenance endpoint on the admin router. It takes
+// the instance out of discovery, so it is never served on the service's port.
+func (service *Service) initMaintenance() {
+	service.adminRoute("GET", defaultMaintenancePath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "maintenance": service.Maintenance()})
+	})
+
+	service.adminRoute("POST", defaultMaintenancePath, func(c *gin.Context) {
+		reason := c.Query("reason")
+		if reason == "" {
+			var body MaintenanceStatus
+			if c.Request.ContentLength > 0 && c.BindJSON(&body) != nil {
+				return
+			}
+			reason = body.Reason
+		}
+		service.maintenanceResponse(c, service.EnterMaintenance(reason))
+	})
+
+	service.adminRoute("DELETE", defaultMaintenancePath, func(c *gin.Context) {
+		service.maintenanceResponse(c, service.ExitMaintenance())
+	})
+}
+
+func (service *Service) maintenanceResponse(c *gin.Context, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrNotRegistered || err == registry.ErrMaintenanceNotSupported {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"status": status, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "maintenance": service.Maintenance()})
+}
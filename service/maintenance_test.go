@@ -0,0 +1,104 @@
+package service_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+)
+
+var _ = Describe("Maintenance", func() {
+	var ser *service.Service
+	var adapter *registry.MemoryAdapter
+
+	passing := func() int {
+		entries, err := adapter.CheckService("maintained", "", true)
+		Expect(err).ToNot(HaveOccurred())
+		return len(entries)
+	}
+
+	BeforeEach(func() {
+		adapter = registry.NewMemoryAdapter()
+		ser = service.NewService(registry.ServiceRegistration{
+			Address:       "127.0.0.1",
+			AdvertiseAddr: "127.0.0.1",
+			Port:          13103,
+			Id:            "maintained1",
+			Name:          "maintained",
+			TTL:           "5s",
+		})
+		ser.RegistryAdapter = adapter
+
+		go func() {
+			ser.Run()
+		}()
+		Eventually(passing, 5*time.Second).Should(Equal(1))
+	})
+
+	AfterEach(func() {
+		ser.Stop()
+	})
+
+	It("should leave discovery while in maintenance", func() {
+		Expect(ser.EnterMaintenance("deploying")).To(Succeed())
+		Expect(ser.Maintenance()).To(Equal(service.MaintenanceStatus{Enabled: true, Reason: "deploying"}))
+		Expect(passing()).To(Equal(0))
+
+		_, err := adapter.FindService("maintained", "")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ser.ExitMaintenance()).To(Succeed())
+		Expect(ser.Maintenance().Enabled).To(BeFalse())
+		Expect(passing()).To(Equal(1))
+	})
+
+	It("should be driven from the admin endpoint", func() {
+		ts := httptest.NewServer(ser.Admin)
+		defer ts.Close()
+
+		res, err := http.Post(ts.URL+"/admin/maintenance?reason=deploying", "application/json", nil)
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(ser.Maintenance().Reason).To(Equal("deploying"))
+		Expect(passing()).To(Equal(0))
+
+		req, _ := http.NewRequest("DELETE", ts.URL+"/admin/maintenance", nil)
+		res, err = http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(ser.Maintenance().Enabled).To(BeFalse())
+	})
+
+	It("should not be driven from the service's port", func() {
+		res, err := http.Post("http://127.0.0.1:13103/admin/maintenance", "application/json", nil)
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(ser.Maintenance().Enabled).To(BeFalse())
+		Expect(passing()).To(Equal(1))
+	})
+
+	It("should toggle on SIGUSR1", func() {
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).To(Succeed())
+		Eventually(func() bool { return ser.Maintenance().Enabled }).Should(BeTrue())
+		Expect(passing()).To(Equal(0))
+
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).To(Succeed())
+		Eventually(func() bool { return ser.Maintenance().Enabled }).Should(BeFalse())
+	})
+
+	It("should refuse maintenance when the service does not register", func() {
+		s := service.NewService(registry.ServiceRegistration{Name: "unregistered", SkipRegistration: true})
+		s.RegistryAdapter = adapter
+		Expect(s.EnterMaintenance("")).To(Equal(service.ErrNotRegistered))
+	})
+})
@@ -0,0 +1,90 @@
+package service_test
+
+import (
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("RunContext", func() {
+	newService := func(name string, port int) *service.Service {
+		s := service.NewService(registry.ServiceRegistration{
+			Address:          "127.0.0.1",
+			Port:             port,
+			Id:               name + "1",
+			Name:             name,
+			SkipRegistration: true,
+		})
+		s.RegistryAdapter = registry.NewMemoryAdapter()
+		return s
+	}
+
+	run := func(s *service.Service, ctx context.Context) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- s.RunContext(ctx)
+		}()
+		return errs
+	}
+
+	live := func(port int) error {
+		res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/health/live", port))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+
+	It("should run services side by side until their context is cancelled", func() {
+		a := newService("embedded-a", 13106)
+		b := newService("embedded-b", 13107)
+
+		ctxA, cancelA := context.WithCancel(context.Background())
+		defer cancelA()
+		ctxB, cancelB := context.WithCancel(context.Background())
+		defer cancelB()
+
+		errsA := run(a, ctxA)
+		errsB := run(b, ctxB)
+
+		Eventually(a.Ready()).Should(BeClosed())
+		Eventually(b.Ready()).Should(BeClosed())
+		Expect(live(13106)).To(Succeed())
+		Expect(live(13107)).To(Succeed())
+
+		cancelA()
+		Eventually(errsA).Should(Receive(BeNil()))
+		Expect(a.Draining()).To(BeTrue())
+		Expect(live(13106)).ToNot(Succeed())
+
+		Expect(live(13107)).To(Succeed())
+		b.Stop()
+		Eventually(errsB).Should(Receive(BeNil()))
+	})
+
+	It("should fail without becoming ready when the address is taken", func() {
+		a := newService("embedded-a", 13106)
+		b := newService("embedded-b", 13106)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		errsA := run(a, ctx)
+		Eventually(a.Ready()).Should(BeClosed())
+
+		errsB := run(b, ctx)
+		Eventually(errsB).Should(Receive(HaveOccurred()))
+		Expect(b.Ready()).ToNot(BeClosed())
+
+		cancel()
+		Eventually(errsA).Should(Receive(BeNil()))
+	})
+})
@@ -3,30 +3,35 @@ package service
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 	"github.com/mailgun/manners"
 	"gitlab.vailsys.com/vail-cloud-services/platform"
+	"gitlab.vailsys.com/vail-cloud-services/platform/discovery/consul"
 	"gitlab.vailsys.com/vail-cloud-services/platform/heimdal"
 	"gitlab.vailsys.com/vail-cloud-services/platform/middleware"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+
+	"golang.org/x/net/context"
 )
 
 const (
-	// Interval between consul heartbeats
-	defaultRegisterInterval = 2 * time.Second
+	// How often and how long the registry's HTTP check polls the local
+	// readiness
+	defaultHealthCheckInterval = "10s"
+	defaultHealthCheckTimeout  = "2s"
 )
 
 var (
 	ErrInvalidHandler        = errors.New("invalid service handler")
 	ErrInvalidHandlerMethods = errors.New("invalid service handler methods")
+	ErrInvalidMiddleware     = errors.New("invalid middleware handler")
+	ErrAlreadyRun            = errors.New("service already run or stopped")
 )
 
 type Service struct {
@@ -34,30 +39,96 @@ type Service struct {
 	Router          *gin.Engine
 	ServiceHandlers []ServiceHandler
 	RegistryAdapter registry.RegistryAdapter
+	RegistryConfig  registry.Config
 	ServiceClients  []heimdal.HttpServiceClient
 	Logger          *logrus.Logger
+	DrainDelay      time.Duration
+	DrainTimeout    time.Duration
+	TLS             *TLSConfig
+	Admin           *gin.Engine
+	AdminAddr       string
 	pulse           *registry.Pulse
+	electors        []*registry.LeaderElector
+	locks           []*registry.Lock
+	semaphores      []*registry.Semaphore
+	jobs            []*jobRunner
+	jobsStarted     bool
+	maintenance     *MaintenanceStatus
+	healthChecks    []healthCheck
+	registryStatus  func()
+	registryErr     error
+	started         bool
+	draining        bool
+	serving         bool
+	ready           chan struct{}
+	certs           *certReloader
+	adminSrv        *http.Server
+	groups          map[string]*gin.RouterGroup
+	served          chan struct{}
+	stopped         chan struct{}
 	mtx             *sync.Mutex
 	srv             *manners.GracefulServer
 }
 
+// Options configures a service beyond its registration. Registry is the
+// config of the service's registry adapter. Its adapter URIs default to the
+// registration's ConsulNodes, or to the local agent, and its RefreshTTL to the
+// registration's TTL. Its DeregisterCriticalAfter applies when the
+// registration does not set its own.
+//
+// LivenessPath and ReadinessPath move the health endpoints off /health/live
+// and /health/ready, for routers that serve those paths themselves. The
+// registry's HTTP check polls the local readiness on ReadinessPath.
+// SkipHealthEndpoints mounts neither endpoint nor declares the check, for
+// routers with a conflicting wildcard route.
+type Options struct {
+	Registry            registry.Config
+	LivenessPath        string
+	ReadinessPath       string
+	SkipHealthEndpoints bool
+}
+
+// NewService returns a service on the registry named by the registration.
+// When the registry cannot be configured, the error is returned by Run.
 func NewService(registration registry.ServiceRegistration) *Service {
+	service, _ := NewServiceWithOptions(registration, Options{})
+	return service
+}
+
+// NewServiceWithOptions returns a service configured with opts. It returns
+// the service along with the error when its registry cannot be configured,
+// which Run returns as well.
+func NewServiceWithOptions(registration registry.ServiceRegistration, opts Options) (*Service, error) {
 
 	router := gin.New()
 
 	service := &Service{
 		Registration:    registration,
 		Router:          router,
+		Admin:           gin.New(),
 		ServiceHandlers: make([]ServiceHandler, 0),
 		ServiceClients:  make([]heimdal.HttpServiceClient, 0),
+		groups:          make(map[string]*gin.RouterGroup),
 		mtx:             &sync.Mutex{},
 		Logger:          platform.Logger,
+		ready:           make(chan struct{}),
+		served:          make(chan struct{}),
+		stopped:         make(chan struct{}),
 	}
 
 	//router.Use(requestId(service.Name()))
 	router.Use(serviceLogger())
+	router.Use(clientIdentity())
 
-	service.initRegistry()
+	service.initAdvertiseAddr()
+	if !opts.SkipHealthEndpoints {
+		service.initHealthCheck(opts.readinessPath())
+		service.initHealthEndpoints(opts.livenessPath(), opts.readinessPath())
+	}
+	registryErr := service.initRegistry(opts.Registry)
+	service.initAdmin()
+	service.initJobs()
+	service.initMaintenance()
 
 	addr := fmt.Sprintf("%v:%v", service.Registration.Address, service.Registration.Port)
 	srv := manners.NewWithServer(&http.Server{
@@ -68,28 +139,75 @@ func NewService(registration registry.ServiceRegistration) *Service {
 	})
 	service.srv = srv
 
-	return service
+	return service, registryErr
 }
 
-func (service *Service) initRegistry() error {
-	nodes := service.Registration.ConsulNodes
-	var node string
+// initAdvertiseAddr fills in a blank AdvertiseAddr, the address other hosts
+// reach the service on. Address is the address the server listens on, so it
+// is advertised as is when it names a single host, and otherwise the host's
+// address is picked with the registration's AdvertiseOptions.
+func (service *Service) initAdvertiseAddr() {
+	sr := &service.Registration
+	if sr.AdvertiseAddr != "" {
+		return
+	}
+
+	if ip := net.ParseIP(sr.Address); ip != nil && !ip.IsUnspecified() {
+		sr.AdvertiseAddr = sr.Address
+		return
+	}
+
+	ip, err := platform.AdvertiseAddr(sr.AdvertiseOptions)
+	if err != nil {
+		service.Logger.Warnf("unable to pick an advertise address for %s: %s", sr.Name, err)
+		return
+	}
+	sr.AdvertiseAddr = ip.String()
+	service.Logger.Infof("service %s advertising address %s", sr.Name, sr.AdvertiseAddr)
+}
+
+// initHealthCheck declares an HTTP check against the local readiness of the
+// service, so that the registry stops routing to it as soon as it drains or
+// one of its own checks fails, but not when one of its dependencies is down.
+func (service *Service) initHealthCheck(readinessPath string) {
+	path := readinessPath + "?" + localReadinessQuery
+	for _, check := range service.Registration.Checks {
+		if check.Type == registry.CheckHTTP && check.Path == path {
+			return
+		}
+	}
+
+	check := registry.HTTPCheck(path, defaultHealthCheckInterval, defaultHealthCheckTimeout)
+	service.Registration.Checks = append(service.Registration.Checks, check)
+}
 
-	if len(nodes) == 0 {
-		node = "consul://127.0.0.1:8500"
-	} else {
-		node = nodes[0]
+// initRegistry connects the registry adapter configured by config.
+// RegistryConfig drives the heartbeat interval and TTL of the registration
+// and the refresh interval of the service's publishers.
+func (service *Service) initRegistry(config registry.Config) error {
+	if config.AdapterURI == "" && len(config.AdapterURIs) == 0 {
+		config.AdapterURIs = service.Registration.ConsulNodes
+	}
+	if config.AdapterURI == "" && len(config.AdapterURIs) == 0 {
+		config.AdapterURIs = []string{"consul://127.0.0.1:8500"}
 	}
 
-	config := registry.Config{
-		AdapterURI:      node,
-		RefreshTTL:      5,
-		RefreshInterval: 20,
+	// the registration's own TTL wins, otherwise it heartbeats on the
+	// registry default
+	if ttl, err := time.ParseDuration(service.Registration.TTL); err == nil && ttl > 0 {
+		config.RefreshTTL = ttl
+	}
+	if service.Registration.TTL == "" {
+		service.Registration.TTL = config.TTL().String()
 	}
 
+	service.RegistryConfig = config
+
 	adapter, err := registry.NewBackend(config)
 	if err != nil {
-		service.Logger.Infof("registry backend error: %s", err)
+		service.Logger.Errorf("registry backend error: %s", err)
+		service.registryErr = err
+		return err
 	}
 
 	service.RegistryAdapter = adapter
@@ -113,45 +231,71 @@ func (service *Service) register() error {
 
 	service.Logger.Infof("service %s registered with consul", service.Registration.Name)
 
-	pulser, err := registry.NewPulser(defaultRegisterInterval, service.Registration, service.RegistryAdapter)
+	pulser, err := registry.NewPulser(service.RegistryConfig.Interval(), service.Registration, service.RegistryAdapter)
 
 	if err != nil {
 		return err
 	}
 
+	service.mtx.Lock()
 	service.pulse = pulser
+	service.mtx.Unlock()
 
 	return nil
 }
 
-func (service *Service) AddHandler(sh ServiceHandler) error {
-	if sh.Handler == nil {
-		return ErrInvalidHandler
+// AddHandler routes sh on the service's router. The handler runs after the
+// global middleware, then sh.Middlewares and mws in the order declared.
+func (service *Service) AddHandler(sh ServiceHandler, mws ...middleware.Middleware) error {
+	sh, err := prepareHandler(sh, mws)
+	if err != nil {
+		return err
 	}
 
-	if len(sh.Methods) == 0 {
-		return ErrInvalidHandlerMethods
+	service.addHandlers(&service.Router.RouterGroup, sh)
+
+	return nil
+}
+
+// AddGroupedHandler routes sh under group, after the middleware added to the
+// group with AddGroupMiddleware and before sh's own middleware.
+func (service *Service) AddGroupedHandler(group string, sh ServiceHandler, mws ...middleware.Middleware) error {
+	sh, err := prepareHandler(sh, mws)
+	if err != nil {
+		return err
 	}
 
-	service.addHandlers(&service.Router.RouterGroup, sh)
+	service.addHandlers(service.group(group), sh)
 
 	return nil
 }
 
-func (service *Service) AddGroupedHandler(group string, sh ServiceHandler) error {
+// prepareHandler validates sh and appends mws to its middleware.
+func prepareHandler(sh ServiceHandler, mws []middleware.Middleware) (ServiceHandler, error) {
 	if sh.Handler == nil {
-		return ErrInvalidHandler
+		return sh, ErrInvalidHandler
 	}
 
 	if len(sh.Methods) == 0 {
-		return ErrInvalidHandlerMethods
+		return sh, ErrInvalidHandlerMethods
 	}
 
-	gHandler := service.Router.Group(group)
-
-	service.addHandlers(gHandler, sh)
+	middlewares := make([]gin.HandlerFunc, 0, len(sh.Middlewares)+len(mws))
+	for _, m := range sh.Middlewares {
+		if m == nil {
+			return sh, ErrInvalidMiddleware
+		}
+		middlewares = append(middlewares, m)
+	}
+	for _, m := range mws {
+		if m == nil || m.GinFunc() == nil {
+			return sh, ErrInvalidMiddleware
+		}
+		middlewares = append(middlewares, m.GinFunc())
+	}
+	sh.Middlewares = middlewares
 
-	return nil
+	return sh, nil
 }
 
 func (service *Service) SetNotFoundHandler(h gin.HandlerFunc) error {
@@ -165,22 +309,36 @@ func (service *Service) SetNotFoundHandler(h gin.HandlerFunc) error {
 func (service *Service) AddMiddleware(m middleware.Middleware) error {
 	handler := m.GinFunc()
 	if handler == nil {
-		return fmt.Errorf("invalid middleware handler")
+		return ErrInvalidMiddleware
 	}
 	service.Router.Use(handler)
 	return nil
 }
 
+// AddGroupMiddleware adds m to every handler added under group afterwards.
 func (service *Service) AddGroupMiddleware(group string, m middleware.Middleware) error {
 	handler := m.GinFunc()
 	if handler == nil {
-		return fmt.Errorf("invalid middleware handler")
+		return ErrInvalidMiddleware
 	}
-	gHandler := service.Router.Group(group)
-	gHandler.Use(handler)
+	service.group(group).Use(handler)
 	return nil
 }
 
+// group returns the router group for path, creating it on first use so that
+// its middleware applies to every handler added under it.
+func (service *Service) group(path string) *gin.RouterGroup {
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+
+	g, ok := service.groups[path]
+	if !ok {
+		g = service.Router.Group(path)
+		service.groups[path] = g
+	}
+	return g
+}
+
 func (service *Service) AddServiceClient(c heimdal.HttpServiceClient) {
 	_, err := service.GetServiceClient(c.ServiceName)
 	if err != nil {
@@ -188,6 +346,14 @@ func (service *Service) AddServiceClient(c heimdal.HttpServiceClient) {
 	}
 }
 
+// NewPublisher returns a publisher of the healthy instances of the named
+// service, refreshed from the service's registry every refresh interval and
+// snapshotted to RegistryConfig.SnapshotDir when it is set.
+func (service *Service) NewPublisher(name string) *consul.ConsulPublisher {
+	opts := consul.PublisherOptions{SnapshotDir: service.RegistryConfig.SnapshotDir}
+	return consul.NewConsulPublisherWithOptions(service.RegistryAdapter, name, service.RegistryConfig.Interval(), opts)
+}
+
 func (service *Service) GetServiceClient(name string) (*heimdal.HttpServiceClient, error) {
 	service.Logger.Debugf("finding service for name: %s", name)
 	for _, c := range service.ServiceClients {
@@ -198,16 +364,118 @@ func (service *Service) GetServiceClient(name string) (*heimdal.HttpServiceClien
 	return nil, fmt.Errorf("service client with name: %s does not exist", name)
 }
 
+// NewLock returns a distributed lock on key backed by the service's registry.
+// The lock is released when the service stops.
+func (service *Service) NewLock(key string, opts registry.LockOptions) (*registry.Lock, error) {
+	lock, err := registry.NewLock(service.RegistryAdapter, key, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+	service.locks = append(service.locks, lock)
+	return lock, nil
+}
+
+// NewLeaderElector returns an elector campaigning on key through the
+// service's registry. It is stopped, giving up leadership, when the service
+// stops.
+func (service *Service) NewLeaderElector(key string, opts registry.LockOptions) (*registry.LeaderElector, error) {
+	elector, err := registry.NewLeaderElector(service.RegistryAdapter, key, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+	service.electors = append(service.electors, elector)
+	return elector, nil
+}
+
+// NewSemaphore returns a distributed semaphore under prefix backed by the
+// service's registry. Unless opts names its own checks, slots are tied to the
+// service's heartbeat check, so they are freed when the instance stops
+// heartbeating. Slots still held are released when the service stops.
+func (service *Service) NewSemaphore(prefix string, limit int, opts registry.LockOptions) (*registry.Semaphore, error) {
+	if len(opts.Checks) == 0 && !service.Registration.SkipRegistration {
+		opts.Checks = []string{service.Registration.HeartbeatCheckID()}
+	}
+
+	sem, err := registry.NewSemaphore(service.RegistryAdapter, prefix, limit, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+	service.semaphores = append(service.semaphores, sem)
+	return sem, nil
+}
+
+// Run runs the service until the process receives one of the
+// ShutdownSignals, and toggles maintenance mode on SIGUSR1. Services embedded
+// in another process, or run from tests, use RunContext instead.
 func (service *Service) Run() error {
+	ctx, cancel := SignalContext(context.Background())
+	defer cancel()
+
+	stop := service.HandleMaintenanceSignal()
+	defer stop()
+
+	return service.RunContext(ctx)
+}
+
+// RunContext binds the service's listener, over TLS when TLS is set, and the
+// admin listener when AdminAddr is set. It then registers the service, starts
+// its jobs and serves requests until ctx is cancelled or Stop is called. It
+// returns once the service is fully drained. A service runs only once, later
+// calls and calls after Stop return ErrAlreadyRun.
+func (service *Service) RunContext(ctx context.Context) error {
 	service.Logger.Infof("running service %s", service.Registration.Name)
 
-	exitChan := make(chan os.Signal, 1)
-	signal.Notify(exitChan, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	if service.registryErr != nil {
+		return service.registryErr
+	}
+
+	service.mtx.Lock()
+	if service.started || service.draining {
+		service.mtx.Unlock()
+		return ErrAlreadyRun
+	}
+	service.started = true
+	service.mtx.Unlock()
+
+	listener, err := net.Listen("tcp", service.srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	if service.TLS != nil {
+		config, err := service.initTLS()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = manners.NewTLSListener(listener, config)
+	}
+
+	if service.AdminAddr != "" {
+		err := service.startAdmin()
+		if err != nil {
+			listener.Close()
+			service.stopTLS()
+			return err
+		}
+	}
 
 	if !service.Registration.SkipRegistration {
 		err := service.register()
 
 		if err != nil {
+			listener.Close()
+			service.stopTLS()
+			service.stopAdmin()
 			service.Logger.Infof("service %s is not registered", service.Name())
 			return err
 		}
@@ -216,23 +484,54 @@ func (service *Service) Run() error {
 		}()
 	}
 
-	//sigexit code
-	go func(e chan os.Signal) {
-		s := <-e
-		service.Logger.Infof("Received signal: %v, shutting down", s)
-		service.Stop()
-	}(exitChan)
+	service.watchRegistry()
+	service.startJobs()
+
+	service.mtx.Lock()
+	service.serving = true
+	service.mtx.Unlock()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- service.srv.Serve(listener)
+		close(service.served)
+	}()
+
+	service.Logger.Infof("service %s listening on %s://%s", service.Registration.Name, service.Registration.Scheme(), listener.Addr())
+	close(service.ready)
+
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+
+	// drains the service, or waits for the drain that stopped the server
+	service.Stop()
+	return err
+}
 
-	return service.srv.ListenAndServe()
+// Ready returns a channel that is closed once the service's listener is bound
+// and the service is registered.
+func (service *Service) Ready() <-chan struct{} {
+	return service.ready
 }
 
+// Stop drains the service before shutting it down. After deregistering it
+// waits DrainDelay, the publisher refresh interval by default, before it
+// stops accepting connections, and then up to DrainTimeout for in-flight
+// requests. Calling it again waits for the first call to finish.
 func (service *Service) Stop() {
-	if service.pulse != nil {
-		service.pulse.Stop()
+	service.mtx.Lock()
+	if service.draining {
+		service.mtx.Unlock()
+		<-service.stopped
+		return
 	}
-	service.stopServiceClients()
-	service.srv.Close()
-	//service.srv.BlockingClose()
+	service.draining = true
+	service.mtx.Unlock()
+
+	service.drain()
+	close(service.stopped)
 }
 
 func (service *Service) Name() string {
@@ -256,13 +555,79 @@ func (service *Service) addHandlers(router *gin.RouterGroup, sh ServiceHandler)
 	for _, path := range sh.Paths {
 		for _, method := range sh.Methods {
 			service.Logger.Debugf("adding handler to service router %s: %s", method, path)
-			router.Handle(method, path, sh.Handler)
+			handlers := append(append([]gin.HandlerFunc(nil), sh.Middlewares...), sh.Handler)
+			router.Handle(method, path, handlers...)
 		}
 	}
 
 	service.ServiceHandlers = append(service.ServiceHandlers, sh)
 }
 
+// RegistryStatus returns the last connection status change of the service's
+// registry adapter.
+func (service *Service) RegistryStatus() registry.StatusChange {
+	notifier, ok := service.RegistryAdapter.(registry.StatusNotifier)
+	if !ok {
+		status := service.RegistryAdapter.Status()
+		return registry.StatusChange{From: status, To: status}
+	}
+	return notifier.LastStatusChange()
+}
+
+// watchRegistry logs when the service loses or regains its registry, since
+// it drops out of discovery and its clients serve stale endpoints meanwhile.
+func (service *Service) watchRegistry() {
+	var lost time.Time
+	cancel, err := registry.SubscribeStatus(service.RegistryAdapter, func(change registry.StatusChange) {
+		if change.To == registry.StatusDisconnected {
+			lost = change.Time
+			service.Logger.Warnf("service %s lost its registry, running degraded: %s", service.Registration.Name, change.LastError)
+			return
+		}
+		if !lost.IsZero() {
+			service.Logger.Infof("service %s reconnected to its registry after %v", service.Registration.Name, change.Time.Sub(lost))
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	service.mtx.Lock()
+	service.registryStatus = cancel
+	service.mtx.Unlock()
+}
+
+func (service *Service) unwatchRegistry() {
+	service.mtx.Lock()
+	cancel := service.registryStatus
+	service.registryStatus = nil
+	service.mtx.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (service *Service) releaseLocks() {
+	service.mtx.Lock()
+	electors := service.electors
+	locks := service.locks
+	semaphores := service.semaphores
+	service.mtx.Unlock()
+
+	for _, e := range electors {
+		e.Stop()
+	}
+	for _, l := range locks {
+		if l.Held() {
+			l.Unlock()
+		}
+	}
+	for _, s := range semaphores {
+		s.Close()
+	}
+}
+
 func (service *Service) stopServiceClients() {
 	for _, c := range service.ServiceClients {
 		service.Logger.Debugf("stoping loadbalancer for %s", c.ServiceName)
@@ -272,10 +637,11 @@ func (service *Service) stopServiceClients() {
 
 func serviceLogger() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		requestId, _ := c.Get("requestid")
+		value, _ := c.Get("requestid")
+		requestId, _ := value.(string)
 
 		path := c.Request.URL.Path
-		platform.Logger.Infof("requestid=%s method=%s path=%s agent=%s host=%s request=%s", requestId.(string), c.Request.Method, c.Request.URL.Path, c.Request.UserAgent(), c.Request.Host, c.Request.RequestURI)
+		platform.Logger.Infof("requestid=%s method=%s path=%s agent=%s host=%s request=%s", requestId, c.Request.Method, c.Request.URL.Path, c.Request.UserAgent(), c.Request.Host, c.Request.RequestURI)
 
 		start := time.Now()
 
@@ -286,7 +652,7 @@ func serviceLogger() gin.HandlerFunc {
 		method := c.Request.Method
 		statusCode := c.Writer.Status()
 
-		platform.Logger.Infof("requestid=%s status=%d latency=%v method=%s path=%s", requestId.(string), statusCode, latency, method, path)
+		platform.Logger.Infof("requestid=%s status=%d latency=%v method=%s path=%s", requestId, statusCode, latency, method, path)
 	}
 }
 
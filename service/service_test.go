@@ -10,6 +10,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"gitlab.vailsys.com/vail-cloud-services/platform"
 	"gitlab.vailsys.com/vail-cloud-services/platform/middleware"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
 	"gitlab.vailsys.com/vail-cloud-services/platform/service"
@@ -27,6 +28,87 @@ var _ = Describe("Service", func() {
 			err := ser.Run()
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("should advertise the listen address or pick one for the host", func() {
+			nodes := []string{"consul://127.0.0.2:8500"}
+			config := registry.ServiceRegistration{Address: "127.0.0.2", Port: 3001, Id: "router1", Name: "bifrost", ConsulNodes: nodes, TTL: "5s"}
+			ser := service.NewService(config)
+			Expect(ser.Registration.AdvertiseAddr).To(Equal("127.0.0.2"))
+
+			config.AdvertiseAddr = "10.0.0.5"
+			ser = service.NewService(config)
+			Expect(ser.Registration.AdvertiseAddr).To(Equal("10.0.0.5"))
+
+			config.Address = "0.0.0.0"
+			config.AdvertiseAddr = ""
+			config.AdvertiseOptions = platform.AddressOptions{Interfaces: []string{"no-such-interface"}}
+			ser = service.NewService(config)
+			Expect(ser.Registration.AdvertiseAddr).To(BeEmpty())
+		})
+
+		It("should heartbeat within the registration TTL", func() {
+			nodes := []string{"consul://127.0.0.2:8500"}
+			config := registry.ServiceRegistration{Address: "127.0.0.2", Port: 3001, Id: "router1", Name: "bifrost", ConsulNodes: nodes, TTL: "1s"}
+			ser := service.NewService(config)
+			Expect(ser.RegistryConfig.TTL()).To(Equal(time.Second))
+			Expect(ser.RegistryConfig.Interval()).To(Equal(500 * time.Millisecond))
+
+			config.TTL = ""
+			ser = service.NewService(config)
+			Expect(ser.Registration.TTL).To(Equal(registry.DefaultRefreshTTL.String()))
+			Expect(ser.RegistryConfig.Interval()).To(Equal(registry.DefaultRefreshInterval))
+		})
+	})
+
+	Context("registry options", func() {
+		It("should configure the registry adapter from the options", func() {
+			config := registry.ServiceRegistration{Address: "127.0.0.2", Port: 3001, Id: "router1", Name: "bifrost", ConsulNodes: []string{"consul://127.0.0.2:8500"}}
+			ser, err := service.NewServiceWithOptions(config, service.Options{Registry: registry.Config{
+				AdapterURI:      "memory://",
+				Token:           "secret",
+				RefreshTTL:      3 * time.Second,
+				RefreshInterval: time.Second,
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ser.RegistryAdapter.Type()).To(Equal("memory"))
+			Expect(ser.RegistryConfig.Token).To(Equal("secret"))
+			Expect(ser.RegistryConfig.Interval()).To(Equal(time.Second))
+			Expect(ser.Registration.TTL).To(Equal("3s"))
+
+			ser, err = service.NewServiceWithOptions(config, service.Options{Registry: registry.Config{RefreshInterval: time.Second}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ser.RegistryConfig.AdapterURIs).To(Equal(config.ConsulNodes))
+			Expect(ser.RegistryConfig.Interval()).To(Equal(time.Second))
+		})
+
+		It("should refuse to run on an invalid registry config", func() {
+			config := registry.ServiceRegistration{Address: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "5s"}
+			ser, err := service.NewServiceWithOptions(config, service.Options{Registry: registry.Config{
+				AdapterURI:      "memory://",
+				RefreshInterval: 10 * time.Second,
+			}})
+			Expect(err).To(HaveOccurred())
+			Expect(ser.RegistryAdapter).To(BeNil())
+			Expect(ser.Run()).To(Equal(err))
+		})
+
+		It("should deregister critical instances after the configured default", func() {
+			config := registry.ServiceRegistration{Address: "127.0.0.1", AdvertiseAddr: "127.0.0.1", Port: 3001, Id: "router1", Name: "bifrost", TTL: "1s"}
+			ser, err := service.NewServiceWithOptions(config, service.Options{Registry: registry.Config{
+				AdapterURI:              "memory://",
+				DeregisterCriticalAfter: 100 * time.Millisecond,
+			}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ser.RegistryConfig.DeregisterCriticalAfter).To(Equal(100 * time.Millisecond))
+
+			Expect(ser.RegistryAdapter.Register(ser.Registration)).To(Succeed())
+			Expect(ser.RegistryAdapter.Sync(ser.Registration)).To(Succeed())
+			Eventually(func() error {
+				_, err := ser.RegistryAdapter.FindService("bifrost", "")
+				return err
+			}, 3*time.Second).Should(Equal(registry.ErrServiceNotFound))
+		})
 	})
 
 	Context("registry is available", func() {
@@ -106,6 +188,18 @@ var _ = Describe("Service", func() {
 				Expect(string(body)).To(Equal("hello world"))
 			})
 
+			It("should declare an HTTP check against its local readiness", func() {
+				Expect(ser.Registration.Checks).To(ContainElement(registry.HTTPCheck("/health/ready?local=true", "10s", "2s")))
+
+				ts := httptest.NewServer(ser.Router)
+				defer ts.Close()
+
+				res, err := http.Get(ts.URL + "/health/ready?local=true")
+				Expect(err).NotTo(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+
 			It("should send heartbeat to the registry", func() {
 				go func() {
 					ser.Run()
@@ -121,6 +215,27 @@ var _ = Describe("Service", func() {
 				Expect(ser.Synced()).To(Equal(false))
 			})
 
+			It("should give up leadership when the service is stopped", func() {
+				elector, err := ser.NewLeaderElector("platform-test/bifrost/leader", registry.LockOptions{SessionTTL: 10 * time.Second})
+				Expect(err).ToNot(HaveOccurred())
+
+				elected := make(chan struct{}, 1)
+				elector.Start(func(lost <-chan struct{}) {
+					elected <- struct{}{}
+					<-lost
+				})
+
+				go func() {
+					ser.Run()
+				}()
+
+				Eventually(elected, 10*time.Second).Should(Receive())
+				Expect(elector.IsLeader()).To(BeTrue())
+
+				ser.Stop()
+				Expect(elector.IsLeader()).To(BeFalse())
+			})
+
 			It("should shutdown all discovery clients when service is stopped", func() {
 				go func() {
 					ser.Run()
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+
+	"golang.org/x/net/context"
+)
+
+// Signals that shut down a service started with Run
+var ShutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM}
+
+// SignalContext returns a context that is cancelled when the process receives
+// one of the ShutdownSignals. Pass it to RunContext to stop the service on
+// those signals.
+func SignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, ShutdownSignals...)
+
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case s := <-signals:
+			platform.Logger.Infof("Received signal: %v, shutting down", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// HandleMaintenanceSignal toggles maintenance mode whenever the process
+// receives SIGUSR1, until the returned function is called.
+func (service *Service) HandleMaintenanceSignal() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	quit := make(chan struct{})
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				service.toggleMaintenance()
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() { close(quit) }
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.vailsys.com/vail-cloud-services/platform"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+)
+
+const (
+	// How often the certificate files are checked for changes
+	defaultTLSReloadInterval = 1 * time.Minute
+
+	// Gin context key holding the verified client's *ClientIdentity
+	ClientIdentityKey = "client_identity"
+)
+
+var ErrInvalidTLSConfig = errors.New("tls requires a certificate and a key file")
+
+// TLSConfig has the service serve https. CertFile and KeyFile are the PEM
+// encoded server certificate and key. Setting ClientCAFile enables mutual
+// TLS: clients must present a certificate signed by one of its CAs. The
+// files are reloaded every ReloadInterval when they change on disk.
+type TLSConfig struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	ReloadInterval time.Duration
+}
+
+// ClientIdentity is the verified certificate a client presented over mutual
+// TLS.
+type ClientIdentity struct {
+	CommonName   string
+	Organization []string
+	DNSNames     []string
+	Certificate  *x509.Certificate
+}
+
+// GetClientIdentity returns the verified identity of the client making the
+// request, if it presented a certificate.
+func GetClientIdentity(c *gin.Context) (*ClientIdentity, bool) {
+	value, ok := c.Get(ClientIdentityKey)
+	if !ok {
+		return nil, false
+	}
+	identity, ok := value.(*ClientIdentity)
+	return identity, ok
+}
+
+// clientIdentity stores the verified client certificate of the request in
+// the gin context.
+func clientIdentity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := c.Request.TLS
+		if state != nil && len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			cert := state.VerifiedChains[0][0]
+			c.Set(ClientIdentityKey, &ClientIdentity{
+				CommonName:   cert.Subject.CommonName,
+				Organization: cert.Subject.Organization,
+				DNSNames:     cert.DNSNames,
+				Certificate:  cert,
+			})
+		}
+		c.Next()
+	}
+}
+
+// initTLS loads the certificates and starts reloading them. It tags the
+// registration with registry.TagHTTPS and adapts the HTTP checks, which the
+// registry then runs over https: it does not verify the certificate, which
+// is not issued for the address it polls, and under mutual TLS the checks
+// become TCP checks since the registry has no client certificate.
+func (service *Service) initTLS() (*tls.Config, error) {
+	certs, err := newCertReloader(*service.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &service.Registration
+	tagged := false
+	for _, t := range sr.Tags {
+		if t == registry.TagHTTPS {
+			tagged = true
+		}
+	}
+	if !tagged {
+		sr.Tags = append(sr.Tags, registry.TagHTTPS)
+	}
+
+	for i, check := range sr.Checks {
+		if check.Type != registry.CheckHTTP {
+			continue
+		}
+		if service.TLS.ClientCAFile != "" {
+			sr.Checks[i] = registry.TCPCheck("", check.Interval, check.Timeout)
+			continue
+		}
+		sr.Checks[i].TLSSkipVerify = true
+	}
+
+	interval := service.TLS.ReloadInterval
+	if interval <= 0 {
+		interval = defaultTLSReloadInterval
+	}
+	go certs.watch(interval)
+
+	service.mtx.Lock()
+	service.certs = certs
+	service.mtx.Unlock()
+
+	return certs.tlsConfig(), nil
+}
+
+func (service *Service) stopTLS() {
+	service.mtx.Lock()
+	certs := service.certs
+	service.certs = nil
+	service.mtx.Unlock()
+
+	if certs != nil {
+		certs.stop()
+	}
+}
+
+// certReloader serves the current certificate and client CAs, swapping them
+// when their files change.
+type certReloader struct {
+	config    TLSConfig
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	quit      chan struct{}
+	mtx       *sync.Mutex
+}
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, ErrInvalidTLSConfig
+	}
+
+	r := &certReloader{
+		config: config,
+		quit:   make(chan struct{}),
+		mtx:    &sync.Mutex{},
+	}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+func (r *certReloader) stat() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[f] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// reload loads every file, keeping the current certificates on error.
+func (r *certReloader) reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.config.ClientCAFile)
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	return nil
+}
+
+// changed reports whether any file was modified since it was last loaded.
+func (r *certReloader) changed() bool {
+	modTimes, err := r.stat()
+	if err != nil {
+		return false
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for f, t := range modTimes {
+		if !t.Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			err := r.reload()
+			if err != nil {
+				platform.Logger.Warnf("unable to reload tls certificate %s: %s", r.config.CertFile, err)
+				continue
+			}
+			platform.Logger.Infof("reloaded tls certificate %s", r.config.CertFile)
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *certReloader) stop() {
+	close(r.quit)
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: r.getCertificate,
+	}
+	if r.config.ClientCAFile == "" {
+		return config
+	}
+
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.clientCAs
+		return c, nil
+	}
+	return config
+}
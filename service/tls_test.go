@@ -0,0 +1,239 @@
+package service_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
+	"gitlab.vailsys.com/vail-cloud-services/platform/service"
+
+	"golang.org/x/net/context"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newCertificate(template *x509.Certificate, parent *testCA) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func newCA() *testCA {
+	cert, key, certPEM, _ := newCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	return &testCA{cert: cert, key: key, pem: certPEM}
+}
+
+func (ca *testCA) issue(cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	_, _, certPEM, keyPEM := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}, ca)
+	return certPEM, keyPEM
+}
+
+var _ = Describe("TLS", func() {
+	var ser *service.Service
+	var adapter *registry.MemoryAdapter
+	var ca *testCA
+	var dir string
+	var cancel context.CancelFunc
+	var errs chan error
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+		return path
+	}
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca.pem)
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "service-tls")
+		Expect(err).ToNot(HaveOccurred())
+
+		ca = newCA()
+		certPEM, keyPEM := ca.issue("server-1", x509.ExtKeyUsageServerAuth)
+
+		adapter = registry.NewMemoryAdapter()
+		ser = service.NewService(registry.ServiceRegistration{
+			Address:       "127.0.0.1",
+			AdvertiseAddr: "127.0.0.1",
+			Port:          13108,
+			Id:            "secure1",
+			Name:          "secure",
+			TTL:           "5s",
+		})
+		ser.RegistryAdapter = adapter
+		ser.DrainDelay = time.Millisecond
+		ser.TLS = &service.TLSConfig{
+			CertFile:       write("server.pem", certPEM),
+			KeyFile:        write("server-key.pem", keyPEM),
+			ReloadInterval: 50 * time.Millisecond,
+		}
+		ser.AddHandler(service.ServiceHandler{
+			Methods: []string{"GET"},
+			Paths:   []string{"/whoami"},
+			Handler: func(c *gin.Context) {
+				identity, ok := service.GetClientIdentity(c)
+				if !ok {
+					c.String(http.StatusOK, "anonymous")
+					return
+				}
+				c.String(http.StatusOK, identity.CommonName)
+			},
+		})
+	})
+
+	start := func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		errs = make(chan error, 1)
+		go func() {
+			errs <- ser.RunContext(ctx)
+		}()
+		Eventually(ser.Ready(), 5*time.Second).Should(BeClosed())
+	}
+
+	whoami := func(c *http.Client) (string, error) {
+		res, err := c.Get("https://127.0.0.1:13108/whoami")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	AfterEach(func() {
+		cancel()
+		Eventually(errs).Should(Receive())
+		os.RemoveAll(dir)
+	})
+
+	It("should serve https and register with the https scheme", func() {
+		start()
+
+		Expect(whoami(client())).To(Equal("anonymous"))
+
+		instances, err := adapter.FindService("secure", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instances).To(HaveLen(1))
+		instance := instances[0]
+		Expect(instance.Tags).To(ContainElement(registry.TagHTTPS))
+		Expect(instance.Scheme()).To(Equal("https"))
+
+		for _, check := range ser.Registration.Checks {
+			if check.Type == registry.CheckHTTP {
+				Expect(check.TLSSkipVerify).To(BeTrue())
+			}
+		}
+	})
+
+	It("should reload the certificate when it changes on disk", func() {
+		start()
+
+		served := func() string {
+			conn, err := tls.Dial("tcp", "127.0.0.1:13108", &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				return err.Error()
+			}
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		Expect(served()).To(Equal("server-1"))
+
+		certPEM, keyPEM := ca.issue("server-2", x509.ExtKeyUsageServerAuth)
+		write("server.pem", certPEM)
+		write("server-key.pem", keyPEM)
+		later := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(ser.TLS.CertFile, later, later)).To(Succeed())
+
+		Eventually(served).Should(Equal("server-2"))
+	})
+
+	It("should require and expose client certificates under mutual TLS", func() {
+		ser.TLS.ClientCAFile = write("ca.pem", ca.pem)
+		start()
+
+		_, err := whoami(client())
+		Expect(err).To(HaveOccurred())
+
+		certPEM, keyPEM := ca.issue("billing", x509.ExtKeyUsageClientAuth)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(whoami(client(cert))).To(Equal("billing"))
+
+		for _, check := range ser.Registration.Checks {
+			Expect(check.Type).ToNot(Equal(registry.CheckHTTP))
+		}
+	})
+
+	It("should not start without a certificate", func() {
+		ser.TLS = &service.TLSConfig{}
+
+		err := ser.RunContext(context.Background())
+		Expect(err).To(Equal(service.ErrInvalidTLSConfig))
+
+		// nothing to stop in AfterEach
+		cancel = func() {}
+		errs = make(chan error, 1)
+		errs <- err
+	})
+})
@@ -2,6 +2,8 @@ package service
 
 import "github.com/gin-gonic/gin"
 
+// ServiceHandler routes Handler on every method and path. Middlewares run
+// before Handler in the order declared, and may abort the request.
 type ServiceHandler struct {
 	Methods     []string
 	Paths       []string
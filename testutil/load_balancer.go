@@ -6,9 +6,9 @@ import (
 	"strconv"
 	"time"
 
-	consul_api "github.com/hashicorp/consul/api"
 	"gitlab.vailsys.com/vail-cloud-services/platform/discovery"
 	"gitlab.vailsys.com/vail-cloud-services/platform/discovery/consul"
+	"gitlab.vailsys.com/vail-cloud-services/platform/registry"
 	"gitlab.vailsys.com/vail-cloud-services/platform/registry/fakes"
 )
 
@@ -24,16 +24,16 @@ func NewMockRoundRobin(name string, ttl time.Duration, urls []*url.URL) discover
 	return rb
 }
 
-func newMockService(name string, urls []*url.URL) []*consul_api.ServiceEntry {
-	var entries []*consul_api.ServiceEntry
+func newMockService(name string, urls []*url.URL) []*registry.HealthEntry {
+	var entries []*registry.HealthEntry
 
 	for _, u := range urls {
 		host, port, _ := net.SplitHostPort(u.Host)
 		p, _ := strconv.Atoi(port)
 
-		e := &consul_api.ServiceEntry{
-			Service: &consul_api.AgentService{
-				Service: name,
+		e := &registry.HealthEntry{
+			Instance: &registry.Instance{
+				Name:    name,
 				Address: host,
 				Port:    p,
 			},